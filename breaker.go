@@ -0,0 +1,268 @@
+package imgwizard
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// FetchRetries is number of retries of failed or timed out original fetch
+	FetchRetries = 2
+	// FetchRetryBackoff is delay before the first retry, it's doubled
+	// for every next one up to FetchRetryMaxBackoff and jittered
+	FetchRetryBackoff    = 100 * time.Millisecond
+	FetchRetryMaxBackoff = 2 * time.Second
+	// BreakerThreshold is number of consecutive failed fetches opening
+	// origin circuit breaker, 0 disables breakers
+	BreakerThreshold = 5
+	// BreakerCooldown is time open breaker fails fast before a probe fetch
+	BreakerCooldown = 30 * time.Second
+
+	breakers   = map[string]*breaker{}
+	breakersMu sync.Mutex
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_HALF_OPEN = "half-open"
+	BREAKER_OPEN      = "open"
+
+	// BREAKERS_MAX bounds number of origin breakers and their metrics
+	BREAKERS_MAX = 256
+)
+
+// breaker is circuit breaker of origin, it's opened after BreakerThreshold
+// consecutive failures, after BreakerCooldown single probe fetch is let
+// through, its success closes the breaker and failure opens it again
+type breaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	used     time.Time
+
+	fetches int64
+	errors  int64
+	retries int64
+}
+
+// getBreaker returns breaker by name, it's created on first use,
+// least recently used breaker without failures is evicted when there
+// are BREAKERS_MAX ones, if all are failing new one isn't kept
+func getBreaker(name string) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[name]
+	if !ok {
+		b = &breaker{name: name, state: BREAKER_CLOSED}
+		if len(breakers) >= BREAKERS_MAX && !evictBreaker() {
+			debug("Too many failing origins, breaker of %s isn't kept", name)
+			return b
+		}
+		breakers[name] = b
+	}
+	b.used = time.Now()
+
+	return b
+}
+
+// evictBreaker removes least recently used breaker without failures,
+// breakersMu must be held
+func evictBreaker() bool {
+	var oldest *breaker
+	for _, b := range breakers {
+		b.mu.Lock()
+		failing := b.failures > 0
+		b.mu.Unlock()
+
+		if !failing && (oldest == nil || b.used.Before(oldest.used)) {
+			oldest = b
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	delete(breakers, oldest.name)
+	return true
+}
+
+// breakerName is origin storage with host of remote original,
+// so a single down media host doesn't stop the others
+func breakerName(ctx *Context) string {
+	if u, err := url.Parse(ctx.OrigImage); err == nil && u.Host != "" {
+		return ctx.Storage + ":" + u.Host
+	}
+
+	return ctx.Storage
+}
+
+// allow reports whether fetch may be done
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < BreakerCooldown {
+			return false
+		}
+		debug("Probing origin %s", b.name)
+		b.state = BREAKER_HALF_OPEN
+		return true
+	case BREAKER_HALF_OPEN:
+		return false
+	}
+
+	return true
+}
+
+// done records fetch result, only failures and timeouts are counted
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fetches++
+	if !retryable(err) {
+		b.state = BREAKER_CLOSED
+		b.failures = 0
+		return
+	}
+
+	b.errors++
+	b.failures++
+	if BreakerThreshold > 0 && (b.state == BREAKER_HALF_OPEN || b.failures >= BreakerThreshold) {
+		if b.state != BREAKER_OPEN {
+			warning("Origin %s circuit breaker is open after %d failures", b.name, b.failures)
+		}
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+	}
+}
+
+// retry counts retried fetch
+func (b *breaker) retry() {
+	b.mu.Lock()
+	b.retries++
+	b.mu.Unlock()
+}
+
+// retryable reports whether fetch error may be temporary: connection
+// error, timeout, 5xx or 429 response, only these ones open breakers
+func retryable(err error) bool {
+	e, ok := err.(*ClassifiedError)
+	return ok && (e.Kind == ErrOriginFailed || e.Kind == ErrOriginTimeout)
+}
+
+// backoff returns jittered delay before retry number n (from 0)
+func backoff(n int) time.Duration {
+	delay := FetchRetryBackoff
+	for i := 0; i < n && delay < FetchRetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > FetchRetryMaxBackoff {
+		delay = FetchRetryMaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// BreakerStatus is state of origin circuit breaker
+type BreakerStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Fetches  int64  `json:"fetches"`
+	Errors   int64  `json:"errors"`
+	Retries  int64  `json:"retries"`
+}
+
+// breakerStatuses returns states of used origins sorted by name
+func breakerStatuses() []BreakerStatus {
+	breakersMu.Lock()
+	var list []*breaker
+	for _, b := range breakers {
+		list = append(list, b)
+	}
+	breakersMu.Unlock()
+
+	var statuses []BreakerStatus
+	for _, b := range list {
+		b.mu.Lock()
+		state := b.state
+		if state == BREAKER_OPEN && time.Since(b.openedAt) >= BreakerCooldown {
+			state = BREAKER_HALF_OPEN
+		}
+		statuses = append(statuses, BreakerStatus{b.name, state, b.failures, b.fetches, b.errors, b.retries})
+		b.mu.Unlock()
+	}
+	sort.Sort(byName(statuses))
+
+	return statuses
+}
+
+type byName []BreakerStatus
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// FetchHealth responds with "ok" status or "degraded" one if any
+// origin breaker is open, breaker states are listed in "origins"
+func FetchHealth(rw http.ResponseWriter, req *http.Request) {
+	health := struct {
+		Status  string          `json:"status"`
+		Origins []BreakerStatus `json:"origins"`
+	}{"ok", breakerStatuses()}
+
+	for _, status := range health.Origins {
+		if status.State != BREAKER_CLOSED {
+			health.Status = "degraded"
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(health)
+}
+
+// FetchMetrics responds with origin metrics in Prometheus text format
+func FetchMetrics(rw http.ResponseWriter, req *http.Request) {
+	statuses := breakerStatuses()
+	states := map[string]int{BREAKER_CLOSED: 0, BREAKER_HALF_OPEN: 1, BREAKER_OPEN: 2}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(rw, "# HELP imgwizard_origin_breaker_state Origin circuit breaker state: 0 - closed, 1 - half-open, 2 - open.")
+	fmt.Fprintln(rw, "# TYPE imgwizard_origin_breaker_state gauge")
+	for _, s := range statuses {
+		fmt.Fprintf(rw, "imgwizard_origin_breaker_state{origin=%q} %d\n", s.Name, states[s.State])
+	}
+
+	for _, metric := range []struct {
+		name, help string
+		value      func(BreakerStatus) int64
+	}{
+		{"fetches", "Original fetches.", func(s BreakerStatus) int64 { return s.Fetches }},
+		{"errors", "Failed or timed out original fetches.", func(s BreakerStatus) int64 { return s.Errors }},
+		{"retries", "Retried original fetches.", func(s BreakerStatus) int64 { return s.Retries }},
+	} {
+		fmt.Fprintf(rw, "# HELP imgwizard_origin_%s_total %s\n", metric.name, metric.help)
+		fmt.Fprintf(rw, "# TYPE imgwizard_origin_%s_total counter\n", metric.name)
+		for _, s := range statuses {
+			fmt.Fprintf(rw, "imgwizard_origin_%s_total{origin=%q} %d\n", metric.name, s.Name, metric.value(s))
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package imgwizard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetBreakers() {
+	breakers = map[string]*breaker{}
+}
+
+func TestBreaker(t *testing.T) {
+	BreakerThreshold = 2
+	BreakerCooldown = 50 * time.Millisecond
+	defer func() {
+		BreakerThreshold = 5
+		BreakerCooldown = 30 * time.Second
+		resetBreakers()
+	}()
+
+	failed := &ClassifiedError{ErrOriginFailed, errors.New("503")}
+	notFound := &ClassifiedError{ErrOriginNotFound, errors.New("404")}
+	refused := &ClassifiedError{ErrOriginRefused, errors.New("403")}
+
+	b := getBreaker("test")
+	steps := []struct {
+		Err   error
+		State string
+	}{
+		{failed, BREAKER_CLOSED},
+		{notFound, BREAKER_CLOSED},
+		{failed, BREAKER_CLOSED},
+		{refused, BREAKER_CLOSED},
+		{failed, BREAKER_CLOSED},
+		{failed, BREAKER_OPEN},
+	}
+
+	for i, step := range steps {
+		if !b.allow() {
+			t.Fatalf("%d. breaker doesn't allow fetch in %s state", i, b.state)
+		}
+		b.done(step.Err)
+		if b.state != step.State {
+			t.Errorf("%d. breaker state is %s, needed %s", i, b.state, step.State)
+		}
+	}
+
+	if b.allow() {
+		t.Errorf("open breaker allows fetch")
+	}
+
+	time.Sleep(BreakerCooldown)
+	if !b.allow() || b.allow() {
+		t.Errorf("half-open breaker must allow single probe fetch")
+	}
+	b.done(failed)
+	if b.state != BREAKER_OPEN {
+		t.Errorf("failed probe left breaker %s", b.state)
+	}
+
+	time.Sleep(BreakerCooldown)
+	b.allow()
+	b.done(nil)
+	if b.state != BREAKER_CLOSED || !b.allow() {
+		t.Errorf("successful probe left breaker %s", b.state)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var failures int32
+	RegisterOrigin("flaky", fakeOrigin{failures: &failures})
+	defer delete(Origins, "flaky")
+
+	FetchRetryBackoff = time.Millisecond
+	BreakerThreshold = 4
+	BreakerCooldown = time.Hour
+	defer func() {
+		FetchRetryBackoff = 100 * time.Millisecond
+		BreakerThreshold = 5
+		BreakerCooldown = 30 * time.Second
+		resetBreakers()
+	}()
+
+	tests := []struct {
+		Failures int32
+		Status   int
+	}{
+		{2, http.StatusOK},
+		{3, http.StatusBadGateway},
+		{1, http.StatusServiceUnavailable},
+	}
+
+	for i, test := range tests {
+		failures = test.Failures
+
+		image, err := getOriginal(&Context{Storage: "flaky", OrigImage: "image.jpg"})
+
+		if err == nil && string(image) != "image.jpg" {
+			t.Errorf("%d. getOriginal returned %q", i, image)
+		}
+
+		if status := errStatus(err); status != test.Status {
+			t.Errorf("%d. getOriginal returned %v, needed status %d", i, err, test.Status)
+		}
+	}
+
+	if b := getBreaker("flaky"); b.retries != 5 || b.errors != 6 {
+		t.Errorf("breaker counted %d retries and %d errors, needed 5 and 6", b.retries, b.errors)
+	}
+
+	rw := httptest.NewRecorder()
+	FetchHealth(rw, nil)
+
+	var health struct {
+		Status  string
+		Origins []BreakerStatus
+	}
+	json.Unmarshal(rw.Body.Bytes(), &health)
+	if health.Status != "degraded" || len(health.Origins) != 1 || health.Origins[0].State != BREAKER_OPEN {
+		t.Errorf("FetchHealth returned %s", rw.Body)
+	}
+
+	rw = httptest.NewRecorder()
+	FetchMetrics(rw, nil)
+	if !strings.Contains(rw.Body.String(), `imgwizard_origin_breaker_state{origin="flaky"} 2`) {
+		t.Errorf("FetchMetrics returned %s", rw.Body)
+	}
+}
+
+func TestFetchRetryBudget(t *testing.T) {
+	var fetches, failures int32 = 0, 5
+	RegisterOrigin("slow", fakeOrigin{fetches: &fetches, failures: &failures, delay: 30 * time.Millisecond})
+	defer delete(Origins, "slow")
+
+	FetchRetries = 5
+	FetchRetryBackoff = time.Millisecond
+	FetchTimeout = 50 * time.Millisecond
+	defer func() {
+		FetchRetries = 2
+		FetchRetryBackoff = 100 * time.Millisecond
+		FetchTimeout = 30 * time.Second
+		resetBreakers()
+	}()
+
+	_, err := getOriginal(&Context{Storage: "slow", OrigImage: "image.jpg"})
+	if status := errStatus(err); status != http.StatusBadGateway || fetches != 2 {
+		t.Errorf("getOriginal returned %d after %d fetches, needed 502 after 2", status, fetches)
+	}
+}
+
+func TestBreakerEviction(t *testing.T) {
+	defer resetBreakers()
+
+	failed := &ClassifiedError{ErrOriginFailed, errors.New("503")}
+	for i := 0; i < BREAKERS_MAX; i++ {
+		getBreaker(fmt.Sprintf("rem:%d.somesite.ua", i)).done(failed)
+	}
+
+	if b := getBreaker("rem:new.somesite.ua"); len(breakers) != BREAKERS_MAX || breakers[b.name] == b {
+		t.Errorf("breaker is kept while all %d are failing", len(breakers))
+	}
+
+	getBreaker("rem:7.somesite.ua").done(nil)
+	getBreaker("rem:9.somesite.ua").done(nil)
+	getBreaker("rem:7.somesite.ua")
+
+	b := getBreaker("rem:new.somesite.ua")
+	if len(breakers) != BREAKERS_MAX || breakers[b.name] != b || breakers["rem:9.somesite.ua"] != nil || breakers["rem:7.somesite.ua"] == nil {
+		t.Errorf("least recently used breaker without failures isn't evicted")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for n, max := range map[int]time.Duration{
+		0:  100 * time.Millisecond,
+		1:  200 * time.Millisecond,
+		3:  800 * time.Millisecond,
+		10: 2 * time.Second,
+	} {
+		if delay := backoff(n); delay < max/2 || delay > max {
+			t.Errorf("backoff(%d) returned %s, needed from %s to %s", n, delay, max/2, max)
+		}
+	}
+}
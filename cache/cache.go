@@ -142,29 +142,85 @@ func (c *Cache) FSSet(key string, value []byte) error {
 		return nil
 	}
 
-	err := os.MkdirAll(path.Dir(key), 0777)
-	if err != nil {
-		return err
+	return c.FSReplace(key, value)
+}
+
+func (c *Cache) S3Set(key string, value []byte) error {
+
+	if len(value) == 0 {
+		return nil
 	}
 
-	err = ioutil.WriteFile(key, value, 0666)
-	if err != nil {
-		return err
+	if _, err := c.S3Get(key); err == nil {
+		return nil
 	}
 
-	return nil
+	return c.S3Replace(key, value)
 }
 
-func (c *Cache) S3Set(key string, value []byte) error {
+func (c *Cache) AzureSet(key string, value []byte) error {
 
 	if len(value) == 0 {
 		return nil
 	}
 
-	if _, err := c.S3Get(key); err == nil {
+	if exists, _ := c.AzureClient.BlobExists(c.AzureContainerName, key); exists == true {
+		return nil
+	}
+
+	return c.AzureReplace(key, value)
+}
+
+// Replace is Set which overwrites existing value
+func (c *Cache) Replace(key string, value []byte) error {
+	if len(value) == 0 {
 		return nil
 	}
 
+	if c.S3BucketName != "" {
+		return c.S3Replace(key, value)
+	}
+
+	if c.AzureContainerName != "" {
+		return c.AzureReplace(key, value)
+	}
+
+	return c.FSReplace(key, value)
+}
+
+// FSReplace writes value to temporary file and renames it,
+// so readers never see partially written value
+func (c *Cache) FSReplace(key string, value []byte) error {
+
+	err := os.MkdirAll(path.Dir(key), 0777)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(path.Dir(key), path.Base(key)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), key)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+func (c *Cache) S3Replace(key string, value []byte) error {
+
 	params := &s3.PutObjectInput{
 		Bucket: aws.String(c.S3BucketName),
 		Key:    aws.String(key),
@@ -176,15 +232,7 @@ func (c *Cache) S3Set(key string, value []byte) error {
 	return err
 }
 
-func (c *Cache) AzureSet(key string, value []byte) error {
-
-	if len(value) == 0 {
-		return nil
-	}
-
-	if exists, _ := c.AzureClient.BlobExists(c.AzureContainerName, key); exists == true {
-		return nil
-	}
+func (c *Cache) AzureReplace(key string, value []byte) error {
 
 	reader := bytes.NewReader(value)
 
@@ -2,44 +2,106 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/shifr/imgwizard"
 )
 
-const VERSION = 1.6
-
 func init() {
 	log.SetOutput(os.Stdout)
 
 	flag.BoolVar(&imgwizard.Version, "v", false, "Check imgwizard version")
 	flag.StringVar(&imgwizard.ListenAddr, "l", "127.0.0.1:8070", "Address to listen on")
-	flag.StringVar(&imgwizard.AllowedMedia, "m", "", "comma separated list of allowed media server hosts")
+	flag.StringVar(&imgwizard.AllowedMedia, "m", "", "comma separated list of allowed media \"[storage:]host[/path]\", host may be \"*.domain\"")
+	flag.StringVar(&imgwizard.DeniedMedia, "deny-media", "", "comma separated list of denied media, same format as -m")
 	flag.StringVar(&imgwizard.AllowedSizes, "s", "", "comma separated list of allowed sizes")
 	flag.StringVar(&imgwizard.CacheDir, "c", "/tmp/imgwizard", "directory for cached files")
 	flag.StringVar(&imgwizard.S3BucketName, "s3-b", "", "AWS S3 cache bucket name")
 	flag.StringVar(&imgwizard.AzureContainerName, "az", "", "Microsoft Azure Storage container name")
+	flag.StringVar(&imgwizard.ConfigFile, "config", "", "path to JSON config file with presets")
 	flag.StringVar(&imgwizard.Default404, "thumb", "", "path to default image if original not found")
+	flag.BoolVar(&imgwizard.DominantColorHeader, "dominant-color", false, "add X-Dominant-Color header to resized images")
 	flag.StringVar(&imgwizard.DirsToSearch, "d", "", "comma separated list of directories to search requested file")
 	flag.StringVar(&imgwizard.Mark, "mark", "images", "Mark for nginx")
+	flag.Int64Var(&imgwizard.OriginalsMemBytes, "originals-mem", 0, "max size of originals cached in memory, 0 - disabled")
+	flag.StringVar(&imgwizard.OriginalsDir, "originals-dir", "", "directory of originals cached on disk, empty - disabled")
+	flag.Int64Var(&imgwizard.OriginalsDiskBytes, "originals-disk", 1<<30, "max size of originals cached on disk")
+	flag.DurationVar(&imgwizard.OriginalsTTL, "originals-ttl", 10*time.Minute, "lifetime of cached originals")
+	flag.DurationVar(&imgwizard.CacheTTL, "cache-ttl", 0, "lifetime of processed images, expired ones are revalidated against originals (0 - never expire)")
 	flag.StringVar(&imgwizard.NoCacheKey, "no-cache-key", "", "Secret key that must be equal X-No-Cache value from request header")
 	flag.StringVar(&imgwizard.Nodes, "nodes", "", "Other imgwizard nodes to ask before process image")
+	flag.BoolVar(&imgwizard.PresetsOnly, "presets-only", false, "allow only named presets instead of sizes in URL")
 	flag.IntVar(&imgwizard.Quality, "q", 0, "image quality after resize")
+	flag.StringVar(&imgwizard.Background, "bg", "ffffff", "default background colour RRGGBB for padding and transparency")
+	flag.StringVar(&imgwizard.LocalSymlinks, "loc-symlinks", "root", "symlinks policy of local images: deny, root (follow inside -d directory) or follow")
+	flag.StringVar(&imgwizard.QuantizeMode, "quantize", "on", "PNG quantization: on, off or auto")
+	flag.IntVar(&imgwizard.MaxBytesMinQuality, "maxbytes-min-q", 30, "minimal quality to fit image into maxbytes")
+	flag.IntVar(&imgwizard.MaxBytesMaxQuality, "maxbytes-max-q", 95, "maximal quality to fit image into maxbytes")
+	flag.BoolVar(&imgwizard.SVGSafe, "svg-safe", true, "refuse SVG with external references or bigger than -svg-max-bytes")
+	flag.IntVar(&imgwizard.SVGMaxBytes, "svg-max-bytes", 1<<20, "max SVG size in safe mode")
+	flag.DurationVar(&imgwizard.FetchConnectTimeout, "fetch-connect-timeout", 5*time.Second, "connect timeout of fetching remote originals")
+	flag.DurationVar(&imgwizard.FetchReadTimeout, "fetch-read-timeout", 10*time.Second, "response headers timeout of fetching remote originals")
+	flag.DurationVar(&imgwizard.FetchTimeout, "fetch-timeout", 30*time.Second, "total timeout of fetching remote originals")
+	flag.StringVar(&imgwizard.UserAgent, "user-agent", imgwizard.UserAgent, "User-Agent of original and node fetches")
+	flag.IntVar(&imgwizard.FetchRetries, "fetch-retries", 2, "retries of failed or timed out original fetch")
+	flag.DurationVar(&imgwizard.FetchRetryBackoff, "fetch-retry-backoff", 100*time.Millisecond, "delay before the first retry, doubled for next ones")
+	flag.DurationVar(&imgwizard.FetchRetryMaxBackoff, "fetch-retry-max-backoff", 2*time.Second, "max delay between retries")
+	flag.IntVar(&imgwizard.BreakerThreshold, "breaker-threshold", 5, "consecutive failed fetches opening origin circuit breaker, 0 - disabled")
+	flag.DurationVar(&imgwizard.BreakerCooldown, "breaker-cooldown", 30*time.Second, "time open circuit breaker fails fast before a probe fetch")
+	flag.IntVar(&imgwizard.FetchMaxRedirects, "fetch-max-redirects", 5, "max redirects of fetching remote originals")
+	flag.StringVar(&imgwizard.FetchAllowNets, "fetch-allow-nets", "", "comma separated list of private networks (CIDR) or IPs allowed to fetch originals from")
+	flag.Int64Var(&imgwizard.MaxOriginalBytes, "max-original-bytes", 50<<20, "max original image size, 0 - unlimited")
+	flag.IntVar(&imgwizard.PDFMaxDPI, "pdf-max-dpi", 300, "max DPI to rasterize PDF page with")
+	flag.StringVar(&imgwizard.SignKeys, "sign-keys", "", "comma separated list of keys to verify URL signatures")
+	flag.BoolVar(&imgwizard.Thumbor, "thumbor", false, "Serve thumbor compatible URLs")
+	flag.StringVar(&imgwizard.ThumborStorage, "thumbor-storage", "rem", "storage for thumbor image paths without scheme (loc, rem, az, s3)")
+}
+
+// sign prints signed URLs, e.g. "imgwizard sign -key secret rem/320x240/media.com/image.jpg"
+func sign(args []string) {
+	cmd := flag.NewFlagSet("sign", flag.ExitOnError)
+	key := cmd.String("key", "", "key to sign URL with")
+	mark := cmd.String("mark", "images", "Mark for nginx")
+	cmd.Parse(args)
+
+	if *key == "" || cmd.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: imgwizard sign -key KEY [-mark MARK] PATH...")
+		os.Exit(2)
+	}
+
+	for _, path := range cmd.Args() {
+		fmt.Println(imgwizard.SignedURL(*key, *mark, path))
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		sign(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if imgwizard.Version {
-		log.Println("Version:", VERSION)
+		log.Println("Version:", imgwizard.VERSION)
 		return
 	}
 
 	imgwizard.GlobalSettings.Load()
 
 	r := new(imgwizard.RegexpHandler)
+	if imgwizard.GlobalSettings.ThumborExp != nil {
+		r.HandleFunc(imgwizard.GlobalSettings.ThumborExp, imgwizard.FetchThumborImage)
+	}
+	r.HandleFunc(imgwizard.GlobalSettings.PlaceholderExp, imgwizard.FetchPlaceholder)
+	r.HandleFunc(imgwizard.GlobalSettings.InfoExp, imgwizard.FetchInfo)
+	r.HandleFunc(imgwizard.GlobalSettings.PaletteExp, imgwizard.FetchPalette)
+	r.HandleFunc(imgwizard.GlobalSettings.HealthExp, imgwizard.FetchHealth)
+	r.HandleFunc(imgwizard.GlobalSettings.MetricsExp, imgwizard.FetchMetrics)
 	r.HandleFunc(imgwizard.GlobalSettings.UrlExp, imgwizard.FetchImage)
 
 	log.Printf("ImgWizard started on http://%s", imgwizard.ListenAddr)
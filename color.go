@@ -0,0 +1,251 @@
+package imgwizard
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	COLOR_SAMPLES      = 100
+	PALETTE_SIZE       = 5
+	PALETTE_MAX_SIZE   = 16
+	PALETTE_THUMB_SIZE = 100
+)
+
+// PaletteColor is a palette colour with its share of the image pixels
+type PaletteColor struct {
+	Color string  `json:"color"`
+	Ratio float64 `json:"ratio"`
+}
+
+// Palette is a palette endpoint response
+type Palette struct {
+	DominantColor string         `json:"dominant_color"`
+	Palette       []PaletteColor `json:"palette"`
+}
+
+// colorBox is a median cut box of pixels
+type colorBox []color.NRGBA
+
+// FetchPalette serves JSON with dominant colour and palette of the original,
+// "colors" param sets palette size (default 5, max 16)
+func FetchPalette(rw http.ResponseWriter, req *http.Request) {
+	serveMeta(rw, req, GlobalSettings.PaletteExp, makePalette,
+		func(rw http.ResponseWriter, ctx *Context, data []byte) {
+			writeJSON(rw, data)
+		})
+}
+
+func makePalette(orig []byte, ctx *Context) ([]byte, error) {
+	colors, err := strconv.Atoi(ctx.Values.Get("colors"))
+	if err != nil || colors <= 0 || colors > PALETTE_MAX_SIZE {
+		colors = PALETTE_SIZE
+	}
+
+	img, _, err := thumbnail(orig, PALETTE_THUMB_SIZE, DEFAULT_QUALITY)
+	if err != nil {
+		return nil, err
+	}
+
+	palette := Palette{
+		DominantColor: hexColor(dominantColor(img)),
+		Palette:       []PaletteColor{},
+	}
+
+	boxes := medianCut(samplePixels(img, COLOR_SAMPLES, false), colors)
+	total := 0
+	for _, box := range boxes {
+		total += len(box)
+	}
+
+	for _, box := range boxes {
+		palette.Palette = append(palette.Palette, PaletteColor{
+			Color: hexColor(box.average()),
+			Ratio: float64(len(box)) / float64(total),
+		})
+	}
+
+	return json.Marshal(palette)
+}
+
+// samplePixels returns pixels of the image taken on a grid
+// of at most samples x samples points, without alpha only
+// opaque pixels are returned
+func samplePixels(img image.Image, samples int, alpha bool) []color.NRGBA {
+	var pixels []color.NRGBA
+
+	bounds := img.Bounds()
+	step := 1
+	size := bounds.Dx()
+	if bounds.Dy() > size {
+		size = bounds.Dy()
+	}
+	if size > samples {
+		step = (size + samples - 1) / samples
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if alpha {
+				pixels = append(pixels, c)
+			} else if c.A >= 128 {
+				c.A = 255
+				pixels = append(pixels, c)
+			}
+		}
+	}
+
+	return pixels
+}
+
+// dominantColor returns the most frequent colour of the image,
+// colours are grouped by 4 high bits of every channel
+func dominantColor(img image.Image) color.NRGBA {
+	var best uint16
+	var groups = map[uint16]colorBox{}
+
+	for _, c := range samplePixels(img, COLOR_SAMPLES, false) {
+		key := uint16(c.R>>4)<<8 | uint16(c.G>>4)<<4 | uint16(c.B>>4)
+		groups[key] = append(groups[key], c)
+
+		if len(groups[key]) > len(groups[best]) || len(groups[key]) == len(groups[best]) && key < best {
+			best = key
+		}
+	}
+
+	if len(groups[best]) == 0 {
+		return color.NRGBA{}
+	}
+
+	return groups[best].average()
+}
+
+// medianCut splits pixels into at most n boxes of similar colours,
+// boxes are sorted by size
+func medianCut(pixels []color.NRGBA, n int) []colorBox {
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	boxes := []colorBox{colorBox(pixels)}
+
+	for len(boxes) < n {
+		index, channel, widest := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, size := box.widestChannel(); size > widest {
+				index, channel, widest = i, c, size
+			}
+		}
+
+		if index < 0 {
+			break
+		}
+
+		box := boxes[index]
+		sort.Slice(box, func(i, j int) bool {
+			return channelValue(box[i], channel) < channelValue(box[j], channel)
+		})
+		// split at median value keeping equal values in one box
+		value := channelValue(box[len(box)/2], channel)
+		median := sort.Search(len(box), func(i int) bool {
+			return channelValue(box[i], channel) >= value
+		})
+		if median == 0 {
+			median = sort.Search(len(box), func(i int) bool {
+				return channelValue(box[i], channel) > value
+			})
+		}
+		boxes[index] = box[:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i]) > len(boxes[j])
+	})
+
+	return boxes
+}
+
+// widestChannel returns channel (R, G, B or A) with the largest range and the range
+func (b colorBox) widestChannel() (int, int) {
+	var lo = [4]int{255, 255, 255, 255}
+	var hi [4]int
+
+	for _, c := range b {
+		for i := range hi {
+			v := int(channelValue(c, i))
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+
+	channel := 0
+	for i := range hi {
+		if hi[i]-lo[i] > hi[channel]-lo[channel] {
+			channel = i
+		}
+	}
+
+	return channel, hi[channel] - lo[channel]
+}
+
+func (b colorBox) average() color.NRGBA {
+	var sum [4]uint64
+
+	if len(b) == 0 {
+		return color.NRGBA{}
+	}
+
+	for _, c := range b {
+		for i := range sum {
+			sum[i] += uint64(channelValue(c, i))
+		}
+	}
+
+	n := uint64(len(b))
+	return color.NRGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+}
+
+func channelValue(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	}
+	return c.A
+}
+
+// parseColor parses "RRGGBB" colour, e.g. "bg" param
+func parseColor(s string) (color.NRGBA, error) {
+	if len(s) != 6 {
+		return color.NRGBA{}, fmt.Errorf("Invalid colour %q, RRGGBB expected", s)
+	}
+
+	rgb, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("Invalid colour %q, RRGGBB expected", s)
+	}
+
+	return color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
+
+// hexColor formats colour as "#rrggbb"
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
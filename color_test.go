@@ -0,0 +1,36 @@
+package imgwizard
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestPalette(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, image.Rect(0, 0, 120, 100), image.NewUniform(color.NRGBA{200, 30, 30, 255}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(120, 0, 180, 100), image.NewUniform(color.NRGBA{20, 40, 220, 255}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(180, 0, 200, 100), image.NewUniform(color.NRGBA{250, 250, 250, 255}), image.ZP, draw.Src)
+
+	if dominant := hexColor(dominantColor(img)); dominant != "#c81e1e" {
+		t.Errorf("dominantColor returned %v, needed %v", dominant, "#c81e1e")
+	}
+
+	boxes := medianCut(samplePixels(img, COLOR_SAMPLES, false), 3)
+	expected := []string{"#c81e1e", "#1428dc", "#fafafa"}
+
+	if len(boxes) != len(expected) {
+		t.Fatalf("medianCut returned %d boxes, needed %d", len(boxes), len(expected))
+	}
+
+	for i, box := range boxes {
+		if c := hexColor(box.average()); c != expected[i] {
+			t.Errorf("%d. medianCut box colour %v, needed %v", i, c, expected[i])
+		}
+	}
+
+	if boxes := medianCut(samplePixels(img, COLOR_SAMPLES, false), 10); len(boxes) != 3 {
+		t.Errorf("medianCut returned %d boxes for 3 colours, needed 3", len(boxes))
+	}
+}
@@ -0,0 +1,315 @@
+package imgwizard
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Config is the optional JSON configuration file passed with "-config"
+type Config struct {
+	Presets map[string]Preset       `json:"presets"`
+	Origins map[string]OriginConfig `json:"origins"`
+}
+
+// Preset is a named set of processing options that can be used
+// in the URL instead of the size
+type Preset struct {
+	Size    string            `json:"size"`
+	Mode    string            `json:"mode"`
+	Gravity string            `json:"gravity"`
+	Quality int               `json:"quality"`
+	Format  string            `json:"format"`
+	Filters map[string]string `json:"filters"`
+
+	Background string `json:"background"`
+	Radius     int    `json:"radius"`
+	Mask       string `json:"mask"`
+	Border     string `json:"border"`
+	Density    int    `json:"density"`
+
+	Progressive bool   `json:"progressive"`
+	Subsampling string `json:"subsampling"`
+	Lossless    string `json:"lossless"`
+	Compression int    `json:"compression"`
+
+	Quantize string `json:"quantize"`
+	Colors   int    `json:"colors"`
+	Dither   *bool  `json:"dither"`
+}
+
+// OriginConfig is a named storage of original images,
+// name is used in the URL instead of the storage
+type OriginConfig struct {
+	// loc, rem, az or s3
+	Type string `json:"type"`
+	// base URL of rem origin, e.g. "https://media.example.com"
+	URL string `json:"url"`
+	// S3 bucket or Azure container
+	Bucket string `json:"bucket"`
+	// root directory of loc origin
+	Directory string `json:"directory"`
+	// path prefix added to the path from URL
+	Prefix string `json:"prefix"`
+	// S3 region, AWS_REGION is used if empty
+	Region string `json:"region"`
+	// S3 access key id and secret or Azure account name and key,
+	// environment variables are used if empty
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// request timeout of rem and s3 origins, e.g. "5s"
+	Timeout string `json:"timeout"`
+	// request headers of rem origin
+	Headers map[string]string `json:"headers"`
+	// basic auth credentials or bearer token of rem origin
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	// client request headers forwarded to rem origin
+	ForwardHeaders []string `json:"forward_headers"`
+}
+
+var (
+	sizeExp   = regexp.MustCompile("^[0-9]*x[0-9]*$")
+	presetExp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+	Modes     = []string{"crop", "fit", "pad"}
+	Formats   = []string{"auto", "webp", "jpeg", "png"}
+
+	OriginTypes = []string{"loc", "rem", "az", "s3"}
+
+	// Endpoints take URL part where storage is in image requests
+	Endpoints = []string{"placeholder", "info", "palette"}
+
+	// UnforwardableHeaders are managed by imgwizard itself
+	UnforwardableHeaders = []string{"Host", "Connection", "Content-Length", "Transfer-Encoding",
+		"Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since", "Upgrade", "Te", "Trailer"}
+)
+
+// LoadConfig reads and validates configuration file
+func LoadConfig(filename string) (*Config, error) {
+	var cfg Config
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", filename, err)
+	}
+
+	for name, preset := range cfg.Presets {
+		if err = preset.validate(name); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, origin := range cfg.Origins {
+		if err = origin.validate(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cfg, nil
+}
+
+func (p Preset) validate(name string) error {
+	if !presetExp.MatchString(name) || sizeExp.MatchString(name) {
+		return fmt.Errorf("preset %q: invalid name", name)
+	}
+
+	if !sizeExp.MatchString(p.Size) {
+		return fmt.Errorf("preset %q: invalid size %q", name, p.Size)
+	}
+
+	if p.Mode != "" && !stringExists(p.Mode, Modes) {
+		return fmt.Errorf("preset %q: unknown mode %q", name, p.Mode)
+	}
+
+	if p.Format != "" && !stringExists(p.Format, Formats) {
+		return fmt.Errorf("preset %q: unknown format %q", name, p.Format)
+	}
+
+	if p.Background != "" {
+		if _, err := parseColor(p.Background); err != nil {
+			return fmt.Errorf("preset %q: %s", name, err)
+		}
+	}
+
+	if p.Radius < 0 {
+		return fmt.Errorf("preset %q: negative radius", name)
+	}
+
+	if p.Density < 0 || p.Density > SVG_MAX_DENSITY {
+		return fmt.Errorf("preset %q: density must be 1-%d", name, SVG_MAX_DENSITY)
+	}
+
+	if p.Mask != "" && !stringExists(p.Mask, Masks) {
+		return fmt.Errorf("preset %q: unknown mask %q", name, p.Mask)
+	}
+
+	if p.Border != "" {
+		if _, _, err := parseBorder(p.Border); err != nil {
+			return fmt.Errorf("preset %q: %s", name, err)
+		}
+	}
+
+	if p.Subsampling != "" && !stringExists(p.Subsampling, Subsamplings) {
+		return fmt.Errorf("preset %q: unknown subsampling %q", name, p.Subsampling)
+	}
+
+	if p.Lossless != "" && !stringExists(p.Lossless, Losslesses) {
+		return fmt.Errorf("preset %q: unknown lossless %q", name, p.Lossless)
+	}
+
+	if p.Compression < 0 || p.Compression > 9 {
+		return fmt.Errorf("preset %q: compression must be 1-9", name)
+	}
+
+	if p.Quantize != "" && !stringExists(p.Quantize, QuantizeModes) {
+		return fmt.Errorf("preset %q: unknown quantize %q", name, p.Quantize)
+	}
+
+	if p.Colors != 0 && (p.Colors < 2 || p.Colors > QUANTIZE_COLORS) {
+		return fmt.Errorf("preset %q: colors must be 2-%d", name, QUANTIZE_COLORS)
+	}
+
+	return nil
+}
+
+func (o OriginConfig) validate(name string) error {
+	if !originPrefixExp.MatchString(name) || stringExists(name, OriginTypes) || stringExists(name, Endpoints) {
+		return fmt.Errorf("origin %q: invalid name", name)
+	}
+
+	switch o.Type {
+	case "loc":
+		if o.Directory == "" {
+			return fmt.Errorf("origin %q: directory is required", name)
+		}
+	case "rem":
+		if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("origin %q: invalid url %q", name, o.URL)
+		}
+	case "az", "s3":
+		if o.Bucket == "" {
+			return fmt.Errorf("origin %q: bucket is required", name)
+		}
+	default:
+		return fmt.Errorf("origin %q: unknown type %q", name, o.Type)
+	}
+
+	if o.Timeout != "" {
+		if timeout, err := time.ParseDuration(o.Timeout); err != nil || timeout < 0 {
+			return fmt.Errorf("origin %q: invalid timeout %q", name, o.Timeout)
+		}
+	}
+
+	if o.Type != "rem" && (len(o.Headers) > 0 || o.Username != "" || o.Token != "" || len(o.ForwardHeaders) > 0) {
+		return fmt.Errorf("origin %q: headers and auth are supported by rem origins only", name)
+	}
+
+	if o.Token != "" && o.Username != "" {
+		return fmt.Errorf("origin %q: either username or token can be set", name)
+	}
+
+	for _, header := range o.ForwardHeaders {
+		if stringExists(http.CanonicalHeaderKey(header), UnforwardableHeaders) {
+			return fmt.Errorf("origin %q: header %q can't be forwarded", name, header)
+		}
+	}
+
+	return nil
+}
+
+// Params returns preset as query parameters,
+// filters are applied first so explicit preset fields win
+func (p Preset) Params() url.Values {
+	params := url.Values{}
+
+	for key, value := range p.Filters {
+		params.Set(key, value)
+	}
+
+	if p.Mode != "" {
+		params.Set("mode", p.Mode)
+	}
+
+	if p.Gravity != "" {
+		params.Set("crop", p.Gravity)
+	}
+
+	if p.Quality != 0 {
+		params.Set("q", strconv.Itoa(p.Quality))
+	}
+
+	if p.Format != "" {
+		params.Set("format", p.Format)
+	}
+
+	if p.Background != "" {
+		params.Set("bg", p.Background)
+	}
+
+	if p.Radius != 0 {
+		params.Set("radius", strconv.Itoa(p.Radius))
+	}
+
+	if p.Mask != "" {
+		params.Set("mask", p.Mask)
+	}
+
+	if p.Border != "" {
+		params.Set("border", p.Border)
+	}
+
+	if p.Density != 0 {
+		params.Set("density", strconv.Itoa(p.Density))
+	}
+
+	if p.Progressive {
+		params.Set("progressive", "true")
+	}
+
+	if p.Subsampling != "" {
+		params.Set("subsampling", p.Subsampling)
+	}
+
+	if p.Lossless != "" {
+		params.Set("lossless", p.Lossless)
+	}
+
+	if p.Compression != 0 {
+		params.Set("compression", strconv.Itoa(p.Compression))
+	}
+
+	if p.Quantize != "" {
+		params.Set("quantize", p.Quantize)
+	}
+
+	if p.Colors != 0 {
+		params.Set("colors", strconv.Itoa(p.Colors))
+	}
+
+	if p.Dither != nil {
+		params.Set("dither", strconv.FormatBool(*p.Dither))
+	}
+
+	return params
+}
+
+// Hash returns short preset fingerprint, so changed preset
+// doesn't hit derivatives cached with the old one
+func (p Preset) Hash() string {
+	data, _ := json.Marshal(p)
+	h := fnv.New32a()
+	h.Write(data)
+
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -0,0 +1,104 @@
+package imgwizard
+
+import "testing"
+
+func TestPresetValidate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Preset Preset
+		Valid  bool
+	}{
+		{"thumb", Preset{Size: "100x100"}, true},
+		{"pdp-large", Preset{Size: "800x", Mode: "fit", Format: "webp"}, true},
+		{"og_image", Preset{Size: "1200x630", Mode: "pad", Gravity: "top"}, true},
+		{"100x100", Preset{Size: "100x100"}, false},
+		{"bad/name", Preset{Size: "100x100"}, false},
+		{"thumb", Preset{Size: "big"}, false},
+		{"thumb", Preset{Size: "100x100", Mode: "stretch"}, false},
+		{"thumb", Preset{Size: "100x100", Format: "gif"}, false},
+		{"zoom", Preset{Size: "2000x", Subsampling: "444", Progressive: true}, true},
+		{"zoom", Preset{Size: "2000x", Subsampling: "422"}, false},
+		{"icon", Preset{Size: "64x64", Lossless: "near", Compression: 9}, true},
+		{"icon", Preset{Size: "64x64", Compression: 10}, false},
+		{"card", Preset{Size: "300x200", Mode: "pad", Background: "f0f0f0"}, true},
+		{"card", Preset{Size: "300x200", Background: "#f0f0f0"}, false},
+		{"avatar", Preset{Size: "64x64", Mask: "circle", Border: "2,ffffff"}, true},
+		{"avatar", Preset{Size: "64x64", Mask: "star"}, false},
+		{"avatar", Preset{Size: "64x64", Radius: 8, Border: "2,white"}, false},
+	}
+
+	for i, test := range tests {
+		err := test.Preset.validate(test.Name)
+
+		if test.Valid && err != nil {
+			t.Errorf("%d. validate returned %v, needed nil", i, err)
+		}
+
+		if !test.Valid && err == nil {
+			t.Errorf("%d. validate returned nil, needed error", i)
+		}
+	}
+}
+
+func TestPresetParams(t *testing.T) {
+	preset := Preset{
+		Size:    "320x240",
+		Mode:    "fit",
+		Gravity: "top,left",
+		Quality: 90,
+		Filters: map[string]string{"q": "10", "crop": "bottom", "format": "png"},
+	}
+
+	params := preset.Params()
+	expected := map[string]string{
+		"mode":   "fit",
+		"crop":   "top,left",
+		"q":      "90",
+		"format": "png",
+	}
+
+	for key, value := range expected {
+		if params.Get(key) != value {
+			t.Errorf("Params()[%s] returned %v, needed %v", key, params.Get(key), value)
+		}
+	}
+}
+
+func TestOriginValidate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Origin OriginConfig
+		Valid  bool
+	}{
+		{"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", Timeout: "5s"}, true},
+		{"media", OriginConfig{Type: "rem", URL: "media.somesite.ua"}, false},
+		{"media", OriginConfig{Type: "rem", URL: "ftp://media.somesite.ua"}, false},
+		{"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", Timeout: "5"}, false},
+		{"archive", OriginConfig{Type: "s3", Bucket: "archive", Region: "eu-west-1"}, true},
+		{"archive", OriginConfig{Type: "s3"}, false},
+		{"blobs", OriginConfig{Type: "az", Bucket: "images"}, true},
+		{"uploads", OriginConfig{Type: "loc", Directory: "/var/uploads"}, true},
+		{"uploads", OriginConfig{Type: "loc"}, false},
+		{"rem", OriginConfig{Type: "rem", URL: "https://media.somesite.ua"}, false},
+		{"info", OriginConfig{Type: "rem", URL: "https://media.somesite.ua"}, false},
+		{"placeholder", OriginConfig{Type: "loc", Directory: "/var/uploads"}, false},
+		{"bad/name", OriginConfig{Type: "loc", Directory: "/var/uploads"}, false},
+		{"ftp", OriginConfig{Type: "ftp"}, false},
+		{"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", Token: "t", ForwardHeaders: []string{"Cookie"}}, true},
+		{"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", Token: "t", Username: "u"}, false},
+		{"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", ForwardHeaders: []string{"range"}}, false},
+		{"archive", OriginConfig{Type: "s3", Bucket: "archive", Token: "t"}, false},
+	}
+
+	for i, test := range tests {
+		err := test.Origin.validate(test.Name)
+
+		if test.Valid && err != nil {
+			t.Errorf("%d. validate returned %v, needed nil", i, err)
+		}
+
+		if !test.Valid && err == nil {
+			t.Errorf("%d. validate returned nil, needed error", i)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package imgwizard
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strconv"
+)
+
+const PNG_DEFAULT_COMPRESSION = 6
+
+// Formats to convert resized image to, when requested
+var Encoders = map[string]string{
+	"jpeg": JPEG,
+	"png":  PNG,
+}
+
+var (
+	Subsamplings = []string{"444", "420"}
+	Losslesses   = []string{"true", "near", "false"}
+)
+
+// EncoderOptions are encoder settings besides quality
+type EncoderOptions struct {
+	// progressive JPEG or interlaced PNG
+	Progressive bool
+	// JPEG chroma subsampling "444" or "420" (default)
+	Subsampling string
+	// lossless ("true") or near-lossless ("near") WebP
+	Lossless string
+	// PNG compression level 1-9, 0 - default
+	Compression int
+}
+
+// parseEncoderOptions parses encoder params, invalid values are ignored
+func parseEncoderOptions(values url.Values) EncoderOptions {
+	var enc EncoderOptions
+
+	enc.Progressive, _ = strconv.ParseBool(values.Get("progressive"))
+
+	if subsampling := values.Get("subsampling"); stringExists(subsampling, Subsamplings) {
+		enc.Subsampling = subsampling
+	}
+
+	if lossless := values.Get("lossless"); stringExists(lossless, Losslesses) && lossless != "false" {
+		enc.Lossless = lossless
+	}
+
+	if compression, err := strconv.Atoi(values.Get("compression")); err == nil && compression >= 1 && compression <= 9 {
+		enc.Compression = compression
+	}
+
+	return enc
+}
+
+// appliesTo reports whether any option is set for the image type
+func (enc EncoderOptions) appliesTo(oType string) bool {
+	switch oType {
+	case JPEG:
+		return enc.Progressive || enc.Subsampling == "444"
+	case WEBP_HEADER:
+		return enc.Lossless != ""
+	case PNG:
+		return enc.Progressive || enc.Compression != 0
+	}
+
+	return false
+}
+
+// convertImage re-encodes image to requested format
+func convertImage(buf []byte, format string, quality int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return buf, err
+	}
+
+	return encodeImage(img, format, quality)
+}
+
+// encodeImage encodes decoded image to requested format
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var out bytes.Buffer
+	var err error
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+	default:
+		err = png.Encode(&out, img)
+	}
+
+	return out.Bytes(), err
+}
+
+// formatName returns format name for detected content type
+func formatName(iType string) string {
+	for format, t := range Encoders {
+		if t == iType {
+			return format
+		}
+	}
+
+	return ""
+}
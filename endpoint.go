@@ -0,0 +1,104 @@
+package imgwizard
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// endpointExp builds URL regexp for endpoints describing the original
+// instead of resizing it: /{mark}/{signature}/{endpoint}/{storage}/{path}
+func endpointExp(endpoint string) *regexp.Regexp {
+	template := fmt.Sprintf(
+		"^/(?P<mark>%s)/(?:(?P<signature>%s)/)?(?P<signed>(?P<endpoint>%s)/(?P<storage>%s)/(?P<path>.+))$",
+		Mark, SIGNATURE_EXP, endpoint, originsExp())
+	debug("Template %s", template)
+
+	exp, _ := regexp.Compile(template)
+	return exp
+}
+
+// FillEndpoint sets up context for endpoint request
+func (c *Context) FillEndpoint(req *http.Request, exp *regexp.Regexp) error {
+	params := parseVars(req, exp)
+
+	c.Endpoint = params["endpoint"]
+	return c.fill(req, params["storage"], "0x0", params["path"], req.URL.Query(), params["query"])
+}
+
+// getOrCreateMeta returns cached endpoint response or makes it
+// from the original image with create func
+func getOrCreateMeta(ctx *Context, create func([]byte, *Context) ([]byte, error)) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if !ctx.NoCache {
+		if data, err = checkCache(ctx); err == nil || ctx.OnlyCache {
+			return data, err
+		}
+	}
+
+	image, err := getOriginal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = create(image, ctx); err != nil {
+		return nil, &ClassifiedError{ErrProcessing, err}
+	}
+
+	debug("Set to cache, key: %s", ctx.CachePath)
+	if err = Cache.Set(ctx.CachePath, data); err != nil {
+		warning("Can't set cache, reason - %s", err)
+	}
+
+	return data, nil
+}
+
+// serveMeta handles endpoint request with create func,
+// result is written with write func
+func serveMeta(rw http.ResponseWriter, req *http.Request, exp *regexp.Regexp,
+	create func([]byte, *Context) ([]byte, error),
+	write func(http.ResponseWriter, *Context, []byte)) {
+
+	if !checkSignature(req, exp) {
+		debug("Invalid signature: %s", req.RequestURI)
+		http.Error(rw, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	context := Context{}
+	if err := context.FillEndpoint(req, exp); err != nil {
+		debug("Invalid params: %s, reason - %s", req.RequestURI, err)
+		http.Error(rw, err.Error(), errorStatus(err))
+		return
+	}
+
+	if !context.allowed() {
+		debug("Media is not allowed: %s", req.RequestURI)
+		http.Error(rw, "Media is not allowed", http.StatusForbidden)
+		return
+	}
+
+	ChanPool <- 1
+	defer func() { <-ChanPool }()
+
+	data, err := getOrCreateMeta(&context, create)
+	if err != nil {
+		warning("Can't get %s of %s, reason - %s", context.Endpoint, context.OrigImage, err)
+		status := errorStatus(err)
+		http.Error(rw, http.StatusText(status), status)
+	} else if context.OnlyCache {
+		rw.Write(data)
+	} else {
+		write(rw, &context, data)
+	}
+}
+
+// writeJSON writes JSON endpoint response
+func writeJSON(rw http.ResponseWriter, data []byte) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.Write(data)
+}
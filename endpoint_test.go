@@ -0,0 +1,64 @@
+package imgwizard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEndpointRoutes(t *testing.T) {
+	Mark = "images"
+
+	var route string
+	handler := func(name string) func(http.ResponseWriter, *http.Request) {
+		return func(http.ResponseWriter, *http.Request) { route = name }
+	}
+
+	r := &RegexpHandler{}
+	r.HandleFunc(endpointExp("placeholder"), handler("placeholder"))
+	r.HandleFunc(endpointExp("info"), handler("info"))
+	r.HandleFunc(endpointExp("palette"), handler("palette"))
+	r.HandleFunc(urlExp("[0-9]*x[0-9]*"), handler("image"))
+
+	tests := []struct {
+		Path  string
+		Route string
+	}{
+		{"/images/info/rem/media.somesite.ua/image.jpg", "info"},
+		{"/images/palette/rem/media.somesite.ua/image.jpg", "palette"},
+		{"/images/rem/320x240/media.somesite.ua/images/info/rem/image.jpg", "image"},
+		{"/images/rem/320x240/media.somesite.ua/images/placeholder/rem/image.jpg", "image"},
+		{"/cdn/images/info/rem/media.somesite.ua/image.jpg", ""},
+	}
+
+	for i, test := range tests {
+		route = ""
+		req, _ := http.NewRequest("GET", "http://localhost"+test.Path, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if route != test.Route {
+			t.Errorf("%d. %s was routed to %q, needed %q", i, test.Path, route, test.Route)
+		}
+	}
+}
+
+func TestServeMetaDenied(t *testing.T) {
+	pool, media := ChanPool, GlobalSettings.Media
+	ChanPool = make(chan int, 1)
+	GlobalSettings.Media.Deny, _ = parseMediaRules("media.somesite.ua")
+	defer func() { ChanPool, GlobalSettings.Media = pool, media }()
+
+	Mark = "images"
+	exp := endpointExp("info")
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/images/info/rem/media.somesite.ua/image.jpg", nil)
+		rw := httptest.NewRecorder()
+		serveMeta(rw, req, exp, nil, nil)
+
+		if rw.Code != http.StatusForbidden || len(ChanPool) != 0 {
+			t.Fatalf("%d. serveMeta returned %d with %d pool slots taken, needed %d with 0",
+				i, rw.Code, len(ChanPool), http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package imgwizard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	FetchConnectTimeout = 5 * time.Second
+	FetchReadTimeout    = 10 * time.Second
+	FetchTimeout        = 30 * time.Second
+	FetchMaxRedirects   = 5
+	MaxOriginalBytes    = int64(50 << 20)
+	FetchAllowNets      string
+
+	// ProxyEnv are proxy variables not used by fetch clients,
+	// proxy would dial addresses refused by the guard
+	ProxyEnv = []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"}
+
+	// forbiddenNets are not dialled when fetching originals
+	// unless they are allowed with "-fetch-allow-nets"
+	forbiddenNets = parseNets(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+		"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8")
+	allowedNets []*net.IPNet
+
+	ErrOriginNotFound    = errors.New("Original image not found")
+	ErrOriginTooBig      = errors.New("Original image is too big")
+	ErrOriginTimeout     = errors.New("Original image fetch timed out")
+	ErrOriginFailed      = errors.New("Original image fetch failed")
+	ErrOriginRefused     = errors.New("Original image request is refused")
+	ErrOriginDenied      = errors.New("Original image address is not allowed")
+	ErrOriginNotModified = errors.New("Original image is not modified")
+	ErrOriginUnavailable = errors.New("Original image storage is unavailable")
+	ErrProcessing        = errors.New("Image can't be processed")
+	ErrBadParams         = errors.New("Bad params")
+)
+
+// dialGuard reports whether resolved IP of "host:port" address may be dialled
+type dialGuard func(addr string, ip net.IP) bool
+
+// ClassifiedError is an error of getting processed image,
+// Kind is one of ErrOrigin* errors, ErrProcessing or ErrBadParams
+type ClassifiedError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ClassifiedError) Error() string {
+	return fmt.Sprintf("%s, reason - %s", e.Kind, e.Err)
+}
+
+// classify wraps error of getting original with its kind
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	err = unwrapNetError(err)
+
+	switch e := err.(type) {
+	case *ClassifiedError:
+		return e
+	case net.Error:
+		if e.Timeout() {
+			return &ClassifiedError{ErrOriginTimeout, err}
+		}
+	case awserr.RequestFailure:
+		return &ClassifiedError{statusKind(e.StatusCode()), err}
+	case awserr.Error:
+		if e.Code() == "NoSuchKey" || e.Code() == "NoSuchBucket" {
+			return &ClassifiedError{ErrOriginNotFound, err}
+		}
+	case storage.AzureStorageServiceError:
+		return &ClassifiedError{statusKind(e.StatusCode), err}
+	}
+
+	if os.IsNotExist(err) {
+		return &ClassifiedError{ErrOriginNotFound, err}
+	}
+
+	return &ClassifiedError{ErrOriginFailed, err}
+}
+
+// statusKind classifies non-200 origin response status,
+// only 5xx and 429 ones may be temporary
+func statusKind(status int) error {
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return ErrOriginNotFound
+	case status == http.StatusNotModified:
+		return ErrOriginNotModified
+	case status >= 500 || status == http.StatusTooManyRequests:
+		return ErrOriginFailed
+	}
+
+	return ErrOriginRefused
+}
+
+// unwrapNetError returns the cause of URL and dial errors
+func unwrapNetError(err error) error {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			if _, ok := e.Err.(*ClassifiedError); !ok {
+				return err
+			}
+			err = e.Err
+		default:
+			return err
+		}
+	}
+}
+
+// errorStatus returns response status code for error of getting image
+func errorStatus(err error) int {
+	e, ok := err.(*ClassifiedError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	switch e.Kind {
+	case ErrOriginNotFound:
+		return http.StatusNotFound
+	case ErrOriginDenied:
+		return http.StatusForbidden
+	case ErrOriginTimeout:
+		return http.StatusGatewayTimeout
+	case ErrOriginUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrOriginTooBig, ErrProcessing:
+		return http.StatusUnprocessableEntity
+	case ErrBadParams:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusBadGateway
+}
+
+// newHTTPClient makes client for fetching originals with connect,
+// response header and total timeouts and redirects limit,
+// only addresses passing guard are dialled, redirects included
+func newHTTPClient(timeout time.Duration, guard dialGuard) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   FetchConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Dial:                  guardedDial(dialer, guard),
+			TLSHandshakeTimeout:   FetchConnectTimeout,
+			ResponseHeaderTimeout: FetchReadTimeout,
+			MaxIdleConnsPerHost:   16,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > FetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", FetchMaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// guardedDial resolves host and dials the first resolved IP passing guard,
+// so host can't be resolved to another IP after the check
+func guardedDial(dialer *net.Dialer, guard dialGuard) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := lookupIP(host, dialer.Timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		err = &ClassifiedError{ErrOriginDenied, fmt.Errorf("%s is not allowed", addr)}
+		for _, ip := range ips {
+			if !guard(addr, ip) {
+				debug("Address %s (%s) is not allowed", addr, ip)
+				continue
+			}
+
+			conn, dialErr := dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+			if dialErr == nil {
+				return conn, nil
+			}
+			err = dialErr
+		}
+
+		return nil, err
+	}
+}
+
+// lookupIP resolves host IPs not longer than timeout
+func lookupIP(host string, timeout time.Duration) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	return ips, nil
+}
+
+// originGuard allows public addresses, allowed nets and hosts
+func originGuard(hosts ...string) dialGuard {
+	return func(addr string, ip net.IP) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		return stringExists(host, hosts) || inNets(ip, allowedNets) || !inNets(ip, forbiddenNets)
+	}
+}
+
+// nodeGuard allows only imgwizard nodes addresses,
+// nodes without port are requested on default port of scheme
+func nodeGuard(nodes []string, scheme string) dialGuard {
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+
+	var addrs []string
+	for _, node := range nodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			node = net.JoinHostPort(node, port)
+		}
+		addrs = append(addrs, node)
+	}
+
+	return func(addr string, ip net.IP) bool {
+		return stringExists(addr, addrs)
+	}
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNets parses CIDRs or single IPs
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets, err := parseNetList(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parseNetList(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
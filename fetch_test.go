@@ -0,0 +1,183 @@
+package imgwizard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+func TestFetchURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/image.jpg":
+			rw.Write([]byte("image"))
+		case "/slow.jpg":
+			time.Sleep(200 * time.Millisecond)
+		case "/loop.jpg":
+			http.Redirect(rw, req, "/loop.jpg", http.StatusFound)
+		case "/error.jpg":
+			http.Error(rw, "error", http.StatusInternalServerError)
+		case "/busy.jpg":
+			http.Error(rw, "busy", http.StatusTooManyRequests)
+		case "/forbidden.jpg":
+			http.Error(rw, "forbidden", http.StatusForbidden)
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	FetchReadTimeout = 50 * time.Millisecond
+	defer func() { FetchReadTimeout = 10 * time.Second }()
+	client := newHTTPClient(time.Second, func(string, net.IP) bool { return true })
+
+	tests := []struct {
+		Path      string
+		Status    int
+		Retryable bool
+	}{
+		{"/image.jpg", http.StatusOK, false},
+		{"/missing.jpg", http.StatusNotFound, false},
+		{"/slow.jpg", http.StatusGatewayTimeout, true},
+		{"/loop.jpg", http.StatusBadGateway, true},
+		{"/error.jpg", http.StatusBadGateway, true},
+		{"/busy.jpg", http.StatusBadGateway, true},
+		{"/forbidden.jpg", http.StatusBadGateway, false},
+	}
+
+	for i, test := range tests {
+		resp, err := fetchURL(client, server.URL+test.Path, nil)
+		if err == nil {
+			resp.Body.Close()
+			if test.Status != http.StatusOK {
+				t.Errorf("%d. fetchURL returned nil, needed error", i)
+			}
+			continue
+		}
+
+		if status := errorStatus(classify(err)); status != test.Status {
+			t.Errorf("%d. fetchURL error %v gives status %d, needed %d", i, err, status, test.Status)
+		}
+		if retry := retryable(classify(err)); retry != test.Retryable {
+			t.Errorf("%d. fetchURL error %v is retryable %v, needed %v", i, err, retry, test.Retryable)
+		}
+	}
+}
+
+func TestReadOriginal(t *testing.T) {
+	MaxOriginalBytes = 10
+	defer func() { MaxOriginalBytes = 50 << 20 }()
+
+	if data, err := readOriginal(strings.NewReader("0123456789")); err != nil || len(data) != 10 {
+		t.Errorf("readOriginal returned %q, %v", data, err)
+	}
+
+	_, err := readOriginal(strings.NewReader("0123456789a"))
+	if status := errorStatus(err); status != http.StatusUnprocessableEntity {
+		t.Errorf("readOriginal error %v gives status %d, needed %d", err, status, http.StatusUnprocessableEntity)
+	}
+}
+
+// errStatus returns response status of error, 200 if there is no error
+func errStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	return errorStatus(classify(err))
+}
+
+func TestClassify(t *testing.T) {
+	_, notExist := os.Open("/nonexistent/image.jpg")
+
+	tests := []struct {
+		Err  error
+		Kind error
+	}{
+		{notExist, ErrOriginNotFound},
+		{errors.New("connection reset"), ErrOriginFailed},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusForbidden}, ErrOriginRefused},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusServiceUnavailable}, ErrOriginFailed},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusNotFound}, ErrOriginNotFound},
+		{&ClassifiedError{ErrProcessing, errors.New("bad rect")}, ErrProcessing},
+	}
+
+	for i, test := range tests {
+		if err := classify(test.Err).(*ClassifiedError); err.Kind != test.Kind {
+			t.Errorf("%d. classify returned %v, needed %v", i, err.Kind, test.Kind)
+		}
+	}
+}
+
+func TestDialGuard(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("image"))
+	}))
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	tests := []struct {
+		Guard  dialGuard
+		Status int
+	}{
+		{originGuard(), http.StatusForbidden},
+		{originGuard("127.0.0.1"), http.StatusOK},
+		{nodeGuard([]string{addr}, "http"), http.StatusOK},
+		{nodeGuard([]string{"127.0.0.1:1"}, "http"), http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		resp, err := fetchURL(newHTTPClient(time.Second, test.Guard), server.URL, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if status := errStatus(err); status != test.Status {
+			t.Errorf("%d. fetchURL error %v gives status %d, needed %d", i, err, status, test.Status)
+		}
+	}
+
+	allowedNets = parseNets("127.0.0.0/8")
+	defer func() { allowedNets = nil }()
+
+	for _, ip := range []string{"127.0.0.1", "8.8.8.8", "2a00:1450::1"} {
+		if !originGuard()("", net.ParseIP(ip)) {
+			t.Errorf("originGuard denied %s", ip)
+		}
+	}
+
+	for _, ip := range []string{"10.1.2.3", "169.254.169.254", "192.168.0.1", "::1", "fd00::1", "224.0.0.1", "::ffff:10.0.0.1"} {
+		if originGuard()("", net.ParseIP(ip)) {
+			t.Errorf("originGuard allowed %s", ip)
+		}
+	}
+}
+
+func TestNodeGuard(t *testing.T) {
+	tests := []struct {
+		Scheme string
+		Addr   string
+		Result bool
+	}{
+		{"http", "node1:80", true},
+		{"http", "node1:443", false},
+		{"https", "node1:443", true},
+		{"https", "node1:80", false},
+		{"https", "node2:8080", true},
+		{"https", "node2:443", false},
+	}
+
+	for i, test := range tests {
+		guard := nodeGuard([]string{"node1", "node2:8080"}, test.Scheme)
+		if result := guard(test.Addr, net.ParseIP("10.0.0.1")); result != test.Result {
+			t.Errorf("%d. nodeGuard returned %v, needed %v", i, result, test.Result)
+		}
+	}
+}
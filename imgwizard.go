@@ -1,15 +1,20 @@
 package imgwizard
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -37,7 +42,7 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, handler func(http.Res
 
 func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, route := range h.routes {
-		if route.pattern.MatchString(r.URL.Path) {
+		if route.pattern.MatchString(r.URL.EscapedPath()) {
 			route.handler.ServeHTTP(w, r)
 			return
 		}
@@ -46,20 +51,39 @@ func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type Context struct {
-	NoCache        bool
-	OnlyCache      bool
-	IsOriginal     bool
-	Width          int
-	Height         int
-	AzureContainer string
-	S3Bucket       string
-	Path           string
-	RequestURI     string
-	CachePath      string
-	Storage        string
-	SubPath        string
-	OrigImage      string
-	Query          string
+	NoCache    bool
+	OnlyCache  bool
+	IsOriginal bool
+	Width      int
+	Height     int
+	Path       string
+	RequestURI string
+	CachePath  string
+	Storage    string
+	SubPath    string
+	OrigImage  string
+	Query      string
+	Values     url.Values
+	Preset     string
+	Format     string
+	Scheme     string
+	Endpoint   string
+	Rect       CropRect
+	Trim       TrimOptions
+	Area       image.Rectangle
+	MaxBytes   int
+	Encoder    EncoderOptions
+	Quantize   QuantizeOptions
+	Shape      ShapeOptions
+	Density    int
+	Page       int
+	Pad        bool
+	Background color.NRGBA
+	Header     http.Header
+	OrigMeta   *OriginMeta
+	Expired    bool
+
+	RequestHeader http.Header
 
 	Options vips.Options
 }
@@ -67,14 +91,24 @@ type Context struct {
 type Settings struct {
 	Scheme       string
 	AllowedSizes []string
-	AllowedMedia []string
+	Media        MediaMatcher
 	Directories  []string
 	Nodes        []string
+	Presets      map[string]Preset
+	Background   color.NRGBA
+	SignKeys     []string
 	UrlExp       *regexp.Regexp
+	ThumborExp   *regexp.Regexp
+
+	PlaceholderExp *regexp.Regexp
+	InfoExp        *regexp.Regexp
+	PaletteExp     *regexp.Regexp
+	HealthExp      *regexp.Regexp
+	MetricsExp     *regexp.Regexp
 }
 
 const (
-	VERSION                  = 1.5
+	VERSION                  = 1.6
 	DEFAULT_POOL_SIZE        = 100000
 	WEBP_HEADER              = "image/webp"
 	JPEG                     = "image/jpeg"
@@ -87,6 +121,13 @@ const (
 	ONLY_CACHE_HEADER        = "X-Cache-Only"
 	NO_CACHE_HEADER          = "X-No-Cache"
 	CACHE_DESTINATION_HEADER = "X-Cache-Destination"
+	TRIM_BOX_HEADER          = "X-Trim-Box"
+	DOMINANT_COLOR_HEADER    = "X-Dominant-Color"
+	QUALITY_HEADER           = "X-Quality"
+	MAXBYTES_SHRINK_STEPS    = 5
+	MAXBYTES_SHRINK_MARGIN   = 0.9
+	HEADERS_CACHE_SUFFIX     = ".headers"
+	VALIDATORS_CACHE_SUFFIX  = ".origin"
 )
 
 var (
@@ -95,6 +136,9 @@ var (
 	ClientConfirmed = false
 	DEFAULT_QUALITY = 80
 
+	MaxBytesMinQuality = 30
+	MaxBytesMaxQuality = 95
+
 	Crop = map[string]vips.Gravity{
 		"top":    vips.NORTH,
 		"right":  vips.EAST,
@@ -102,20 +146,32 @@ var (
 		"left":   vips.WEST,
 	}
 	ResizableImageTypes = []string{"image/jpeg", "image/png"}
-
-	Version            bool
-	ListenAddr         string
-	AllowedMedia       string
-	AllowedSizes       string
-	CacheDir           string
-	S3BucketName       string
-	AzureContainerName string
-	Default404         string
-	DirsToSearch       string
-	Mark               string
-	NoCacheKey         string
-	Nodes              string
-	Quality            int
+	SymlinkPolicies     = []string{"deny", "root", "follow"}
+
+	Version             bool
+	ListenAddr          string
+	AllowedMedia        string
+	DeniedMedia         string
+	AllowedSizes        string
+	CacheDir            string
+	S3BucketName        string
+	AzureContainerName  string
+	Background          = "ffffff"
+	ConfigFile          string
+	Default404          string
+	DominantColorHeader bool
+	DirsToSearch        string
+	Mark                string
+	NoCacheKey          string
+	LocalSymlinks       = "root"
+	Nodes               string
+	PresetsOnly         bool
+	Quality             int
+	QuantizeMode        = "on"
+	SignKeys            string
+	Thumbor             bool
+	ThumborStorage      string
+	UserAgent           = fmt.Sprintf("imgwizard/%v", VERSION)
 
 	ChanPool       chan int
 	Cache          *cache.Cache
@@ -138,7 +194,6 @@ func loadDefaults() {
 	//defaults for vips
 	Options.Crop = true
 	Options.Enlarge = false
-	Options.Extend = vips.EXTEND_WHITE
 	Options.Interpolator = vips.BILINEAR
 
 	pool_size, err := strconv.Atoi(os.Getenv("IMGW_POOL_SIZE"))
@@ -206,34 +261,35 @@ func (c *Context) makeCachePath() {
 		imageFormat = imageNameParts[lastNameIndex]
 	}
 
-	if c.Options.Webp {
+	if preset, ok := GlobalSettings.Presets[c.Preset]; ok {
 		cacheImageName = fmt.Sprintf(
-			"%s_%dx%d_webp", imageName, c.Options.Width, c.Options.Height)
+			"%s_%s_%s", imageName, c.Preset, preset.Hash())
+	} else if c.Endpoint != "" {
+		cacheImageName = fmt.Sprintf("%s_%s", imageName, c.Endpoint)
 	} else {
 		cacheImageName = fmt.Sprintf(
 			"%s_%dx%d", imageName, c.Options.Width, c.Options.Height)
 	}
 
+	if c.Page > 1 {
+		cacheImageName = fmt.Sprintf("%s_p%d", cacheImageName, c.Page)
+	}
+
+	if c.Options.Webp {
+		cacheImageName = fmt.Sprintf("%s_webp", cacheImageName)
+	}
+
 	if imageFormat != "" {
 		cacheImageName = fmt.Sprintf("%s.%s", cacheImageName, imageFormat)
 	}
 
+	if c.Endpoint != "" {
+		cacheImageName = fmt.Sprintf("%s.json", cacheImageName)
+	}
+
 	subPath = strings.Join(pathParts[:lastIndex], "/")
-	switch c.Storage {
-	case "loc":
-		c.OrigImage, _ = url.QueryUnescape(c.Path)
-	case "az":
-		c.AzureContainer = pathParts[0]
-		subPath = strings.Join(pathParts[1:lastIndex], "/")
-		c.OrigImage, _ = url.QueryUnescape(fmt.Sprintf(
-			"%s/%s", subPath, pathParts[lastIndex]))
-	case "s3":
-		c.S3Bucket = pathParts[0]
-		subPath = strings.Join(pathParts[1:lastIndex], "/")
-		c.OrigImage, _ = url.QueryUnescape(fmt.Sprintf(
-			"%s/%s", subPath, pathParts[lastIndex]))
-	case "rem":
-		c.OrigImage = fmt.Sprintf("%s://%s", GlobalSettings.Scheme, c.Path)
+	if origin, ok := Origins[c.Storage]; ok {
+		c.OrigImage, subPath = origin.Locate(c, c.Path)
 	}
 
 	if c.CachePath != "" {
@@ -254,46 +310,140 @@ func (c *Context) makeCachePath() {
 	}
 }
 
-func (c *Context) Fill(req *http.Request) {
+// setHeader sets response header for processed image
+func (c *Context) setHeader(key, value string) {
+	if c.Header == nil {
+		c.Header = http.Header{}
+	}
+	c.Header.Set(key, value)
+}
+
+func (c *Context) Fill(req *http.Request) error {
+	params := parseVars(req, GlobalSettings.UrlExp)
+	values := req.URL.Query()
+	size := params["size"]
+	query := params["query"]
+
+	if preset, ok := GlobalSettings.Presets[size]; ok {
+		c.Preset = size
+		size = preset.Size
+		values = preset.Params()
+		query = ""
+	}
+
+	return c.fill(req, params["storage"], size, params["path"], values, query)
+}
+
+// fill sets up context from request and already parsed URL parts,
+// query is used as a part of cache key
+func (c *Context) fill(req *http.Request, storage, size, path string, values url.Values, query string) error {
 	acceptedTypes := strings.Split(req.Header.Get("Accept"), ",")
 	noCacheKey := req.Header.Get(NO_CACHE_HEADER)
 	onlyCacheHeader := req.Header.Get(ONLY_CACHE_HEADER)
 	cachePath := req.Header.Get(CACHE_DESTINATION_HEADER)
-	params := parseVars(req)
-	sizes := strings.Split(params["size"], "x")
 	c.Options = Options
 	c.Options.Gravity = vips.CENTRE
+	c.Options.Webp = c.Endpoint == "" && stringExists(WEBP_HEADER, acceptedTypes)
 
-	if crop := req.FormValue("crop"); crop != "" {
-		for _, g := range strings.Split(crop, ",") {
-			if v, ok := Crop[g]; ok {
-				c.Options.Gravity = c.Options.Gravity | v
-			}
-		}
-	}
-
-	if q := req.FormValue("q"); q != "" {
-		c.Options.Quality, _ = strconv.Atoi(q)
+	c.Background = GlobalSettings.Background
+	c.RequestHeader = req.Header
+	c.Values = values
+	if err := c.applyParams(values); err != nil {
+		return err
 	}
 
 	if o := req.FormValue("original"); o != "" {
 		c.IsOriginal = true
 	}
 
-	c.Options.Webp = stringExists(WEBP_HEADER, acceptedTypes)
+	sizes := strings.Split(size, "x")
 	c.Options.Width, _ = strconv.Atoi(sizes[0])
 	c.Options.Height, _ = strconv.Atoi(sizes[1])
 
 	c.NoCache = NoCacheKey != "" && NoCacheKey == noCacheKey
 	c.OnlyCache = onlyCacheHeader != ""
 	c.RequestURI = req.RequestURI
-	c.Storage = params["storage"]
-	c.Path = params["path"]
-	c.Query = params["query"]
+	c.Storage = storage
+	c.Path = path
+	c.Query = query
 
 	c.CachePath = cachePath
 
 	c.makeCachePath()
+
+	return nil
+}
+
+// applyParams sets processing options from query or preset parameters,
+// malformed rect or trim is an ErrBadParams error
+func (c *Context) applyParams(values url.Values) error {
+	if crop := values.Get("crop"); crop != "" {
+		for _, g := range strings.Split(crop, ",") {
+			if v, ok := Crop[g]; ok {
+				c.Options.Gravity = c.Options.Gravity | v
+			}
+		}
+	}
+
+	if q := values.Get("q"); q != "" {
+		c.Options.Quality, _ = strconv.Atoi(q)
+	}
+
+	c.Encoder = parseEncoderOptions(values)
+	c.Quantize = parseQuantizeOptions(values)
+	c.Shape = parseShapeOptions(values)
+
+	if bg := values.Get("bg"); bg != "" {
+		var err error
+		if c.Background, err = parseColor(bg); err != nil {
+			debug("Ignoring bg, reason - %s", err)
+			c.Background = GlobalSettings.Background
+		}
+	}
+
+	if density, err := strconv.Atoi(values.Get("density")); err == nil && density > 0 && density <= SVG_MAX_DENSITY {
+		c.Density = density
+	}
+
+	if page, err := strconv.Atoi(values.Get("page")); err == nil && page > 0 {
+		c.Page = page
+	}
+
+	if maxBytes := values.Get("maxbytes"); maxBytes != "" {
+		c.MaxBytes, _ = strconv.Atoi(maxBytes)
+	}
+
+	if rect := values.Get("rect"); rect != "" {
+		var err error
+		if c.Rect, err = parseCropRect(rect); err != nil {
+			return &ClassifiedError{ErrBadParams, err}
+		}
+	}
+
+	if trim, ok := values["trim"]; ok {
+		var err error
+		if c.Trim, err = parseTrim(trim[0]); err != nil {
+			return &ClassifiedError{ErrBadParams, err}
+		}
+	}
+
+	switch values.Get("mode") {
+	case "fit":
+		c.Options.Crop = false
+	case "pad":
+		c.Options.Crop = false
+		c.Pad = true
+	}
+
+	c.Format = values.Get("format")
+	switch c.Format {
+	case "webp":
+		c.Options.Webp = true
+	case "jpeg", "png":
+		c.Options.Webp = false
+	}
+
+	return nil
 }
 
 // loadSettings loads settings from command-line
@@ -302,14 +452,8 @@ func (s *Settings) Load() {
 
 	s.Scheme = "http"
 	s.AllowedSizes = nil
-	s.AllowedMedia = nil
 
 	var sizes = "[0-9]*x[0-9]*"
-	var medias = ""
-
-	if AllowedMedia != "" {
-		s.AllowedMedia = strings.Split(AllowedMedia, ",")
-	}
 
 	if AllowedSizes != "" {
 		s.AllowedSizes = strings.Split(AllowedSizes, ",")
@@ -323,158 +467,185 @@ func (s *Settings) Load() {
 		s.Nodes = strings.Split(Nodes, ",")
 	}
 
-	if Quality != 0 {
-		DEFAULT_QUALITY = Quality
+	var err error
+	if s.Background, err = parseColor(Background); err != nil {
+		log.Fatalf("Can't parse -bg, reason - %s", err)
 	}
-	Options.Quality = DEFAULT_QUALITY
 
-	if len(s.AllowedSizes) > 0 {
-		sizes = strings.Join(s.AllowedSizes, "|")
+	if !stringExists(LocalSymlinks, SymlinkPolicies) {
+		log.Fatalf("Unknown symlinks policy %q, use one of %s", LocalSymlinks, strings.Join(SymlinkPolicies, ", "))
 	}
 
-	if len(s.AllowedMedia) > 0 {
-		medias = strings.Join(s.AllowedMedia, "|")
+	if !stringExists(QuantizeMode, QuantizeModes) {
+		log.Fatalf("Unknown quantize mode %q, use one of %s", QuantizeMode, strings.Join(QuantizeModes, ", "))
 	}
 
-	template := fmt.Sprintf(
-		"/(?P<mark>%s)/(?P<storage>loc|rem|az|s3)/(?P<size>%s)/(?P<path>((%s)(.+)))",
-		Mark, sizes, medias)
-	debug("Template %s", template)
-	s.UrlExp, _ = regexp.Compile(template)
-}
+	if FetchAllowNets != "" {
+		if allowedNets, err = parseNetList(strings.Split(FetchAllowNets, ",")); err != nil {
+			log.Fatalf("Can't parse -fetch-allow-nets, reason - %s", err)
+		}
+	}
 
-func fileExists(ctx *Context) (string, error) {
-	var filePath string
-	var err error
+	defaultClient = newHTTPClient(FetchTimeout, originGuard())
+	nodeClient = newHTTPClient(FetchTimeout, nodeGuard(s.Nodes, s.Scheme))
 
-	debug("Trying to find local image")
-
-	if len(GlobalSettings.Directories) > 0 {
-		for _, dir := range GlobalSettings.Directories {
-			filePath = path.Join("/", dir, ctx.OrigImage)
-			if _, err = os.Stat(filePath); err == nil {
-				return filePath, nil
-			}
+	for _, env := range ProxyEnv {
+		if os.Getenv(env) != "" {
+			warning("%s is set but not used, originals are fetched directly", env)
 		}
-		return "", err
 	}
 
-	filePath = path.Join("/", ctx.OrigImage)
+	if originals, err = newOriginalsCache(); err != nil {
+		log.Fatalf("Can't create originals cache, reason - %s", err)
+	}
 
-	if _, err = os.Stat(filePath); os.IsNotExist(err) {
-		return "", err
+	if SignKeys != "" {
+		s.SignKeys = strings.Split(SignKeys, ",")
+	}
+
+	if ConfigFile != "" {
+		cfg, err := LoadConfig(ConfigFile)
+		if err != nil {
+			log.Fatalf("Could not load config, reason - %s", err)
+		}
+		s.Presets = cfg.Presets
+
+		for name, originCfg := range cfg.Origins {
+			origin, err := newOrigin(name, originCfg)
+			if err != nil {
+				log.Fatalf("Could not create origin, reason - %s", err)
+			}
+			RegisterOrigin(name, origin)
+		}
 	}
 
-	return filePath, nil
+	if Quality != 0 {
+		DEFAULT_QUALITY = Quality
+	}
+	Options.Quality = DEFAULT_QUALITY
 
-}
+	if len(s.AllowedSizes) > 0 {
+		sizes = strings.Join(s.AllowedSizes, "|")
+	}
 
-// getLocalImage fetches original image from file system
-func getLocalImage(ctx *Context, def bool) ([]byte, error) {
-	var image []byte
-	var err error
-	var filePath string
+	if len(s.Presets) > 0 {
+		var names []string
+		for name := range s.Presets {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+		sort.Strings(names)
 
-	if def {
-		filePath = Default404
-	} else {
-		filePath, err = fileExists(ctx)
-		if err != nil {
-			return image, err
+		if PresetsOnly {
+			sizes = strings.Join(names, "|")
+		} else {
+			sizes = fmt.Sprintf("%s|%s", strings.Join(names, "|"), sizes)
 		}
 	}
 
-	file, err := os.Open(filePath)
-	defer file.Close()
+	if s.Media.Allow, err = parseMediaRules(AllowedMedia); err != nil {
+		log.Fatalf("Can't parse -m, reason - %s", err)
+	}
 
-	if err != nil {
-		return image, err
+	if s.Media.Deny, err = parseMediaRules(DeniedMedia); err != nil {
+		log.Fatalf("Can't parse -deny-media, reason - %s", err)
 	}
 
-	info, _ := file.Stat()
-	image = make([]byte, info.Size())
+	s.UrlExp = urlExp(sizes)
 
-	_, err = file.Read(image)
-	if err != nil {
-		return image, err
+	s.ThumborExp = nil
+	if Thumbor {
+		s.ThumborExp = thumborExp
 	}
 
-	return image, nil
+	s.PlaceholderExp = endpointExp("placeholder")
+	s.InfoExp = endpointExp("info")
+	s.PaletteExp = endpointExp("palette")
+	s.HealthExp = regexp.MustCompile("^/health$")
+	s.MetricsExp = regexp.MustCompile("^/metrics$")
 }
 
-// getRemoteImage fetches original image by http url
-func getRemoteImage(ctx *Context, isNode bool) ([]byte, error) {
-	var image []byte
-	var client = &http.Client{}
+// urlExp builds URL regexp for images:
+// /{mark}/{signature}/{storage}/{size}/{path}
+func urlExp(sizes string) *regexp.Regexp {
+	template := fmt.Sprintf(
+		"^/(?P<mark>%s)/(?:(?P<signature>%s)/)?(?P<signed>(?P<storage>%s)/(?P<size>%s)/(?P<path>.+))$",
+		Mark, SIGNATURE_EXP, originsExp(), sizes)
+	debug("Template %s", template)
 
-	debug("Trying to fetch remote image: %s", ctx.OrigImage)
+	exp, _ := regexp.Compile(template)
+	return exp
+}
 
-	req, _ := http.NewRequest("GET", ctx.OrigImage, nil)
+// fileExists looks for original image in search directories,
+// image out of them is not allowed
+func fileExists(name string) (string, error) {
+	var filePath string
+	var err error
 
-	if isNode {
-		req.Header.Set(ONLY_CACHE_HEADER, "true")
-		req.Header.Set(CACHE_DESTINATION_HEADER, ctx.CachePath)
+	debug("Trying to find local image")
 
-		if ctx.Options.Webp {
-			req.Header.Set("Accept", WEBP_HEADER)
-		}
+	if len(GlobalSettings.Directories) == 0 {
+		return "", &ClassifiedError{ErrOriginDenied, errors.New("No directories to search local images (-d)")}
 	}
 
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		return image, err
-	}
+	for _, dir := range GlobalSettings.Directories {
+		if filePath, err = rootedPath(dir, name); err == nil {
+			return filePath, nil
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return image, errors.New("Not found")
+		if e, ok := err.(*ClassifiedError); ok && e.Kind == ErrOriginDenied {
+			return "", err
+		}
 	}
 
-	image, err = ioutil.ReadAll(resp.Body)
-
-	return image, nil
+	return "", err
 }
 
-// getAzureImage fetches original image AzureStorage
-func getAzureImage(ctx *Context) ([]byte, error) {
-	var image []byte
-	var err error
-
-	debug("Trying to fetch azure image: '%s'", ctx.OrigImage)
-	rc, err := AzureClient.GetBlob(ctx.AzureContainer, ctx.OrigImage)
-	if err != nil {
-		return image, err
+// rootedPath returns real path of existing file in root directory,
+// symlinks are followed according to LocalSymlinks policy,
+// name climbing above the root is denied
+func rootedPath(root, name string) (string, error) {
+	if clean := path.Clean(strings.TrimPrefix(name, "/")); clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &ClassifiedError{ErrOriginDenied, fmt.Errorf("%s is out of %s", name, root)}
 	}
-	defer rc.Close()
 
-	image, err = ioutil.ReadAll(rc)
+	root = filepath.Join("/", root)
+	filePath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
 
-	return image, err
-}
-
-// getS3Image fetches original image from AWS S3 storage
-func getS3Image(ctx *Context) ([]byte, error) {
-	var image []byte
-	var err error
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
 
-	debug("Trying to fetch S3 image: '%s'", ctx.OrigImage)
+	realPath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return "", err
+	}
 
-	params := &s3.GetObjectInput{
-		Bucket: aws.String(ctx.S3Bucket),
-		Key:    aws.String(ctx.OrigImage),
+	denied := false
+	switch LocalSymlinks {
+	case "deny":
+		rel, _ := filepath.Rel(root, filePath)
+		denied = realPath != filepath.Join(realRoot, rel)
+	case "root":
+		denied = !inDir(realRoot, realPath)
 	}
 
-	resp, err := S3Client.GetObject(params)
+	if denied {
+		return "", &ClassifiedError{ErrOriginDenied, fmt.Errorf("%s is out of %s", name, root)}
+	}
 
-	if err != nil {
-		return image, err
+	if info, err := os.Stat(realPath); err != nil || info.IsDir() {
+		return "", &ClassifiedError{ErrOriginNotFound, fmt.Errorf("%s is not a file", name)}
 	}
-	defer resp.Body.Close()
 
-	image, err = ioutil.ReadAll(resp.Body)
+	return realPath, nil
+}
 
-	return image, err
+// inDir reports whether path is in dir or is dir itself
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 func checkCache(ctx *Context) ([]byte, error) {
@@ -490,6 +661,7 @@ func checkCache(ctx *Context) ([]byte, error) {
 	if len(GlobalSettings.Nodes) > 0 && !ctx.OnlyCache {
 		debug("Checking other nodes")
 		if image, err = checkNodes(ctx); err == nil {
+			setValidators(ctx, false)
 			return image, nil
 		}
 	}
@@ -499,119 +671,122 @@ func checkCache(ctx *Context) ([]byte, error) {
 }
 
 func checkNodes(ctx *Context) ([]byte, error) {
-	var image []byte
-	var err error
-	context := *ctx
+	header := http.Header{}
+	header.Set(ONLY_CACHE_HEADER, "true")
+	header.Set(CACHE_DESTINATION_HEADER, ctx.CachePath)
+	if ctx.Options.Webp {
+		header.Set("Accept", WEBP_HEADER)
+	}
 
 	for _, node := range GlobalSettings.Nodes {
-		context.OrigImage = fmt.Sprintf("%s://%s%s", GlobalSettings.Scheme, node, context.RequestURI)
-		if image, err = getRemoteImage(&context, true); err == nil {
+		nodeURL := fmt.Sprintf("%s://%s%s", GlobalSettings.Scheme, node, ctx.RequestURI)
+		debug("Trying to fetch image from node: %s", nodeURL)
+
+		resp, err := fetchURL(nodeClient, nodeURL, header)
+		if err != nil {
+			continue
+		}
+
+		image, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
 			debug("Found at node: %s", node)
 			return image, nil
 		}
 	}
 
-	return image, errors.New("No one node has the image")
+	return nil, errors.New("No one node has the image")
 }
 
 // getOrCreateImage check cache path for requested image
 // if image doesn't exist - creates it
-func getOrCreateImage(ctx *Context) []byte {
+func getOrCreateImage(ctx *Context) ([]byte, error) {
 
-	var image []byte
+	var image, original []byte
 	var err error
 
 	if !ctx.NoCache {
 		if image, err = checkCache(ctx); err == nil {
-			return image
-		}
-	}
-
-	switch ctx.Storage {
-	case "loc":
-		image, err = getLocalImage(ctx, false)
-		if err != nil {
-			warning("Can't get orig local file - %s, reason - %s", ctx.OrigImage, err)
-			if Default404 != "" {
-				image, err = getLocalImage(ctx, true)
-
+			if original, err = revalidate(ctx); original == nil {
 				if err != nil {
-					warning("Default 404 image was set but not found", Default404)
-					return image
+					warning("Can't revalidate %s, serving expired image, reason - %s", ctx.OrigImage, err)
 				}
+				getCachedHeaders(ctx)
+				return image, nil
 			}
-			return image
 		}
+	}
 
-	case "rem":
-		image, err = getRemoteImage(ctx, false)
-		if err != nil {
-			warning("Can't get orig remote file, reason - %s", err)
-			if Default404 != "" {
-				image, err = getLocalImage(ctx, true)
-
-				if err != nil {
-					warning("Default 404 image was set but not found", Default404)
-					return image
-				}
-			}
-			return image
-		}
-
-	case "az":
-		if !ClientConfirmed {
-			return image
-		}
-
-		image, err = getAzureImage(ctx)
-		if err != nil {
-			warning("Can't get orig Azure file - %s, reason - %s", ctx.OrigImage, err)
-			if Default404 != "" {
-				image, err = getLocalImage(ctx, true)
-
-				if err != nil {
-					warning("Default 404 image was set but not found", Default404)
-					return image
-				}
-			}
-			return image
-		}
-
-	case "s3":
-		if !ClientConfirmed {
-			return image
-		}
-
-		image, err = getS3Image(ctx)
-		if err != nil {
-			warning("Can't get orig AWS S3 file - %s, reason - %s", ctx.OrigImage, err)
-			if Default404 != "" {
-				image, err = getLocalImage(ctx, true)
-
-				if err != nil {
-					warning("Default 404 image was set but not found", Default404)
-					return image
-				}
+	if image = original; image == nil {
+		image, err = getOriginal(ctx)
+	}
+	if err != nil {
+		warning("Can't get orig %s file - %s, reason - %s", ctx.Storage, ctx.OrigImage, err)
+		if e, ok := err.(*ClassifiedError); ok && e.Kind == ErrOriginNotFound && Default404 != "" {
+			if image, defErr := getDefaultImage(); defErr == nil {
+				return image, nil
 			}
-			return image
+			warning("Default 404 image was set but not found: %s", Default404)
 		}
+		return nil, err
 	}
 
 	if ctx.IsOriginal {
 		debug("Returning original image as requested...")
-		return image
+		return image, nil
 	}
 
 	debug("Processing image...")
-	Transform(&image, ctx)
+	if err = Transform(&image, ctx); err != nil {
+		warning("Can't process image - %s, reason - %s", ctx.OrigImage, err)
+		if _, ok := err.(*ClassifiedError); !ok {
+			err = &ClassifiedError{ErrProcessing, err}
+		}
+		return nil, err
+	}
 
 	debug("Set to cache, key: %s", ctx.CachePath)
-	err = Cache.Set(ctx.CachePath, image)
+	err = cacheSet(ctx.CachePath, image, ctx.Expired)
 	if err != nil {
 		warning("Can't set cache, reason - %s", err)
 	}
+	setCachedHeaders(ctx)
+	setValidators(ctx, ctx.Expired)
+
+	return image, nil
+}
+
+// allowed reports whether original is in allowed media
+func (c *Context) allowed() bool {
+	return GlobalSettings.Media.Allowed(c.Storage, c.Path)
+}
+
+// hasHeaders reports whether processed image may have response headers
+func (c *Context) hasHeaders() bool {
+	return c.Trim.Enabled || c.MaxBytes > 0 || DominantColorHeader
+}
+
+// setCachedHeaders stores response headers of processed image next to it
+func setCachedHeaders(ctx *Context) {
+	if len(ctx.Header) == 0 {
+		return
+	}
+
+	data, _ := json.Marshal(ctx.Header)
+	if err := cacheSet(ctx.CachePath+HEADERS_CACHE_SUFFIX, data, ctx.Expired); err != nil {
+		warning("Can't set headers cache, reason - %s", err)
+	}
+}
+
+// getCachedHeaders loads response headers stored with processed image
+func getCachedHeaders(ctx *Context) {
+	if !ctx.hasHeaders() {
+		return
+	}
 
-	return image
+	if data, err := Cache.Get(ctx.CachePath + HEADERS_CACHE_SUFFIX); err == nil {
+		json.Unmarshal(data, &ctx.Header)
+	}
 }
 
 func stringExists(str string, list []string) bool {
@@ -623,28 +798,52 @@ func stringExists(str string, list []string) bool {
 	return false
 }
 
-func parseVars(req *http.Request) map[string]string {
+// parseVars matches escaped path as checkSignature does and unescapes
+// the parts, so the signed URL is the one being processed
+func parseVars(req *http.Request, exp *regexp.Regexp) map[string]string {
 	params := map[string]string{"query": req.URL.RawQuery}
-	match := GlobalSettings.UrlExp.FindStringSubmatch(req.URL.Path)
+	match := exp.FindStringSubmatch(req.URL.EscapedPath())
 
-	for i, name := range GlobalSettings.UrlExp.SubexpNames() {
-		params[name] = match[i]
+	for i, name := range exp.SubexpNames() {
+		params[name], _ = url.PathUnescape(match[i])
 	}
 
 	return params
 }
 
 func FetchImage(rw http.ResponseWriter, req *http.Request) {
+	if !checkSignature(req, GlobalSettings.UrlExp) {
+		debug("Invalid signature: %s", req.RequestURI)
+		http.Error(rw, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	context := Context{}
+	if err := context.Fill(req); err != nil {
+		debug("Invalid params: %s, reason - %s", req.RequestURI, err)
+		http.Error(rw, err.Error(), errorStatus(err))
+		return
+	}
+
+	if !context.allowed() {
+		debug("Media is not allowed: %s", req.RequestURI)
+		http.Error(rw, "Media is not allowed", http.StatusForbidden)
+		return
+	}
+
+	serveImage(rw, req, &context)
+}
+
+// serveImage writes cached or created image for filled context
+func serveImage(rw http.ResponseWriter, req *http.Request, context *Context) {
 	ChanPool <- 1
+	defer func() { <-ChanPool }()
 
 	var resultImage []byte
 	var err error
 
-	context := Context{}
-	context.Fill(req)
-
 	if context.OnlyCache {
-		resultImage, err = checkCache(&context)
+		resultImage, err = checkCache(context)
 
 		if err != nil {
 			http.NotFound(rw, req)
@@ -653,19 +852,25 @@ func FetchImage(rw http.ResponseWriter, req *http.Request) {
 		}
 
 	} else {
-		resultImage = getOrCreateImage(&context)
+		resultImage, err = getOrCreateImage(context)
 		contentLength := len(resultImage)
 
-		if contentLength == 0 {
+		switch {
+		case err != nil:
+			status := errorStatus(err)
+			http.Error(rw, http.StatusText(status), status)
+		case contentLength == 0:
 			debug("Content length 0")
 			http.NotFound(rw, req)
-		}
+		default:
+			for key, values := range context.Header {
+				rw.Header()[key] = values
+			}
 
-		rw.Header().Set("Content-Length", strconv.Itoa(contentLength))
-		rw.Write(resultImage)
+			rw.Header().Set("Content-Length", strconv.Itoa(contentLength))
+			rw.Write(resultImage)
+		}
 	}
-
-	<-ChanPool
 }
 
 func debug(s string, args ...interface{}) {
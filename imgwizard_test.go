@@ -1,6 +1,13 @@
 package imgwizard
 
-import "testing"
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestCachePath(t *testing.T) {
 	tests := []struct {
@@ -95,3 +102,125 @@ func TestCachePath(t *testing.T) {
 		}
 	}
 }
+
+func TestCachePathPage(t *testing.T) {
+	CacheDir = "/tmp/imgwizard"
+
+	for page, expected := range map[int]string{
+		0: "/tmp/imgwizard/docs/report_320x240.pdf",
+		1: "/tmp/imgwizard/docs/report_320x240.pdf",
+		3: "/tmp/imgwizard/docs/report_320x240_p3.pdf",
+	} {
+		context := Context{Storage: "loc", Path: "docs/report.pdf", Page: page}
+		context.Options.Width = 320
+		context.Options.Height = 240
+
+		context.makeCachePath()
+
+		if context.CachePath != expected {
+			t.Errorf("makeCachePath returned %v for page %d, needed %v", context.CachePath, page, expected)
+		}
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	root, err := ioutil.TempDir("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	os.MkdirAll(filepath.Join(root, "media", "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "media", "image.jpg"), []byte("jpg"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "secret.jpg"), []byte("jpg"), 0644)
+	os.Symlink(filepath.Join(root, "media", "image.jpg"), filepath.Join(root, "inside.jpg"))
+	os.Symlink(filepath.Join(outside, "secret.jpg"), filepath.Join(root, "escape.jpg"))
+
+	realRoot, _ := filepath.EvalSymlinks(root)
+	GlobalSettings.Directories = []string{root}
+	defer func() {
+		GlobalSettings.Directories = nil
+		LocalSymlinks = "root"
+	}()
+
+	tests := []struct {
+		Policy string
+		Name   string
+		Status int
+	}{
+		{"root", "media/image.jpg", http.StatusOK},
+		{"root", "/media/../media/image.jpg", http.StatusOK},
+		{"root", "../../../../etc/passwd", http.StatusForbidden},
+		{"follow", "media/../../image.jpg", http.StatusForbidden},
+		{"root", "media/missing.jpg", http.StatusNotFound},
+		{"root", "media/dir", http.StatusNotFound},
+		{"root", "inside.jpg", http.StatusOK},
+		{"root", "escape.jpg", http.StatusForbidden},
+		{"deny", "media/image.jpg", http.StatusOK},
+		{"deny", "inside.jpg", http.StatusForbidden},
+		{"deny", "escape.jpg", http.StatusForbidden},
+		{"follow", "inside.jpg", http.StatusOK},
+		{"follow", "escape.jpg", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		LocalSymlinks = test.Policy
+
+		filePath, err := fileExists(test.Name)
+
+		if err == nil && test.Policy != "follow" && !strings.HasPrefix(filePath, realRoot) {
+			t.Errorf("%d. fileExists(%q) returned %v out of %v", i, test.Name, filePath, realRoot)
+		}
+
+		if status := errStatus(err); status != test.Status {
+			t.Errorf("%d. fileExists(%q) with %q policy returned %d (%v), needed %d", i, test.Name, test.Policy, status, err, test.Status)
+		}
+	}
+
+	GlobalSettings.Directories = nil
+	if _, err := fileExists("media/image.jpg"); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("fileExists without directories returned %v, needed 403", err)
+	}
+}
+
+func TestDefault404(t *testing.T) {
+	thumb, err := ioutil.TempFile("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(thumb.Name())
+	thumb.Write([]byte("thumb"))
+	thumb.Close()
+
+	Default404 = thumb.Name()
+	defer func() { Default404 = "" }()
+
+	RegisterOrigin("fake", fakeOrigin{})
+	defer delete(Origins, "fake")
+	defer resetBreakers()
+
+	tests := []struct {
+		Path   string
+		Image  string
+		Status int
+	}{
+		{"missing.jpg", "thumb", http.StatusOK},
+		{"denied.jpg", "", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		ctx := &Context{NoCache: true, IsOriginal: true, Storage: "fake", OrigImage: test.Path}
+
+		image, err := getOrCreateImage(ctx)
+		if status := errStatus(err); string(image) != test.Image || status != test.Status {
+			t.Errorf("%d. getOrCreateImage(%s) returned %q, %d, needed %q, %d",
+				i, test.Path, image, status, test.Image, test.Status)
+		}
+	}
+}
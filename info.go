@@ -0,0 +1,173 @@
+package imgwizard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"net/http"
+	"strings"
+)
+
+const INFO_THUMB_SIZE = 64
+
+// Info describes the original image, width and height
+// are stored ones, without applying orientation
+type Info struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	Format        string `json:"format"`
+	Size          int    `json:"size"`
+	Orientation   int    `json:"orientation"`
+	Alpha         bool   `json:"alpha"`
+	ColorSpace    string `json:"color_space"`
+	DominantColor string `json:"dominant_color,omitempty"`
+}
+
+// FetchInfo serves JSON info of the original image
+func FetchInfo(rw http.ResponseWriter, req *http.Request) {
+	serveMeta(rw, req, GlobalSettings.InfoExp, makeInfo,
+		func(rw http.ResponseWriter, ctx *Context, data []byte) {
+			writeJSON(rw, data)
+		})
+}
+
+// makeInfo makes JSON info of the original, only header is decoded
+// except dominant colour which is taken from small thumbnail
+func makeInfo(orig []byte, ctx *Context) ([]byte, error) {
+	iType := http.DetectContentType(orig)
+	info := Info{
+		Format:      strings.TrimPrefix(iType, "image/"),
+		Size:        len(orig),
+		Orientation: 1,
+	}
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(orig)); err == nil {
+		info.Width = config.Width
+		info.Height = config.Height
+		info.ColorSpace, info.Alpha = describeColorModel(config.ColorModel)
+	}
+
+	if isSVG(orig) {
+		info.Format = "svg"
+		if width, height, err := parseSVG(orig, false); err == nil {
+			info.Width = int(width + 0.5)
+			info.Height = int(height + 0.5)
+		}
+	}
+
+	switch iType {
+	case JPEG:
+		info.Orientation = jpegOrientation(orig)
+	case PNG:
+		info.Alpha = info.Alpha || pngTransparency(orig)
+	}
+
+	if stringExists(iType, ResizableImageTypes) {
+		if img, _, err := thumbnail(orig, INFO_THUMB_SIZE, DEFAULT_QUALITY); err == nil {
+			info.DominantColor = hexColor(dominantColor(img))
+		} else {
+			warning("Can't get dominant colour, reason - %s", err)
+		}
+	}
+
+	return json.Marshal(info)
+}
+
+// describeColorModel returns colour space name and alpha channel presence
+func describeColorModel(model color.Model) (string, bool) {
+	switch model {
+	case color.GrayModel, color.Gray16Model:
+		return "gray", false
+	case color.CMYKModel:
+		return "cmyk", false
+	case color.NRGBAModel, color.NRGBA64Model:
+		return "srgb", true
+	}
+
+	if palette, ok := model.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return "srgb", true
+			}
+		}
+	}
+
+	return "srgb", false
+}
+
+// pngTransparency reports whether PNG has tRNS chunk,
+// which is not read by image.DecodeConfig for paletted images
+func pngTransparency(buf []byte) bool {
+	idat := bytes.Index(buf, []byte("IDAT"))
+	if idat < 0 {
+		idat = len(buf)
+	}
+
+	return bytes.Contains(buf[:idat], []byte("tRNS"))
+}
+
+// jpegOrientation reads EXIF orientation tag, 1 is returned if it's absent
+func jpegOrientation(buf []byte) int {
+	offset := 2
+
+	for offset+4 <= len(buf) && buf[offset] == 0xff {
+		marker := buf[offset+1]
+		length := int(binary.BigEndian.Uint16(buf[offset+2:]))
+
+		if marker == 0xda || length < 2 || offset+2+length > len(buf) {
+			break
+		}
+
+		segment := buf[offset+4 : offset+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		offset += 2 + length
+	}
+
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+
+	return 1
+}
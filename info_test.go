@@ -0,0 +1,73 @@
+package imgwizard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestJpegOrientation(t *testing.T) {
+	exif := func(order string, orientation byte) []byte {
+		var tiff []byte
+		if order == "II" {
+			tiff = []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, orientation, 0, 0, 0}
+		} else {
+			tiff = []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0}
+		}
+		segment := append([]byte("Exif\x00\x00"), tiff...)
+		length := len(segment) + 2
+
+		buf := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 0, 0, 0xff, 0xe1, byte(length >> 8), byte(length)}
+		buf = append(buf, segment...)
+		return append(buf, 0xff, 0xda, 0, 2)
+	}
+
+	tests := []struct {
+		Image       []byte
+		Orientation int
+	}{
+		{exif("II", 6), 6},
+		{exif("MM", 8), 8},
+		{exif("MM", 9), 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xda, 0, 2}, 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe1, 0xff}, 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe1, 0, 0, 'E', 'x', 'i', 'f', 0, 0}, 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe1, 0, 1, 'E', 'x', 'i', 'f', 0, 0}, 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe0, 0, 2, 0xff, 0xe1, 0, 40, 'E', 'x', 'i', 'f', 0, 0}, 1},
+		{exif("II", 6)[:20], 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe1, 0, 16, 'E', 'x', 'i', 'f', 0, 0, 'I', 'I', 42, 0, 0xff, 0xff, 0xff, 0xff}, 1},
+	}
+
+	for i, test := range tests {
+		if orientation := jpegOrientation(test.Image); orientation != test.Orientation {
+			t.Errorf("%d. jpegOrientation returned %d, needed %d", i, orientation, test.Orientation)
+		}
+	}
+}
+
+func TestPngAlpha(t *testing.T) {
+	tests := []struct {
+		Image image.Image
+		Alpha bool
+	}{
+		{image.NewGray(image.Rect(0, 0, 2, 2)), false},
+		{image.NewNRGBA(image.Rect(0, 0, 2, 2)), true},
+		{image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White}), false},
+		{image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.Transparent}), true},
+	}
+
+	for i, test := range tests {
+		var buf bytes.Buffer
+		png.Encode(&buf, test.Image)
+
+		config, _, _ := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		_, alpha := describeColorModel(config.ColorModel)
+		alpha = alpha || pngTransparency(buf.Bytes())
+
+		if alpha != test.Alpha {
+			t.Errorf("%d. alpha detected %v, needed %v", i, alpha, test.Alpha)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package imgwizard
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// MEDIA_HOST_DELIMITERS would make URL host differ from the checked one
+const MEDIA_HOST_DELIMITERS = "?#@\\% "
+
+// MediaRule is "[storage:]host[/path/prefix]" entry of allowed or denied media,
+// host is the first path part ("*.domain" matches subdomains),
+// rule without storage applies to every storage
+type MediaRule struct {
+	Storage string
+	Host    string
+	Prefix  string
+}
+
+// MediaMatcher checks original path against allowed and denied media,
+// denied ones win, everything is allowed if there are no allowed media
+type MediaMatcher struct {
+	Allow []MediaRule
+	Deny  []MediaRule
+}
+
+// parseMediaRules parses comma separated media rules,
+// storage prefix is recognized only for registered origins
+func parseMediaRules(list string) ([]MediaRule, error) {
+	var rules []MediaRule
+
+	for _, entry := range strings.Split(list, ",") {
+		var rule MediaRule
+
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if i := strings.Index(entry, ":"); i > 0 {
+			if _, ok := Origins[entry[:i]]; ok {
+				rule.Storage, entry = entry[:i], entry[i+1:]
+			}
+		}
+
+		parts := strings.SplitN(entry, "/", 2)
+		rule.Host = strings.ToLower(parts[0])
+		if len(parts) == 2 {
+			rule.Prefix = strings.Trim(path.Clean("/"+parts[1]), "/")
+		}
+
+		if rule.Host == "" || strings.Contains(strings.TrimPrefix(rule.Host, "*."), "*") {
+			return nil, fmt.Errorf("Invalid media %q", entry)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Allowed reports whether original path of the storage is allowed,
+// paths with "." or ".." parts and hosts with URL delimiters are never
+// allowed, as origin would fetch another path than the checked one
+func (m MediaMatcher) Allowed(storage, urlPath string) bool {
+	unescaped, err := url.QueryUnescape(urlPath)
+	if err != nil || dotSegments(urlPath) || dotSegments(unescaped) {
+		return false
+	}
+
+	rawHost := strings.SplitN(urlPath, "/", 2)[0]
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+unescaped), "/"), "/", 2)
+	if strings.ContainsAny(rawHost+parts[0], MEDIA_HOST_DELIMITERS) {
+		return false
+	}
+
+	host, rest := strings.ToLower(parts[0]), ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+
+	for _, rule := range m.Deny {
+		if rule.matches(storage, host, rest) {
+			return false
+		}
+	}
+
+	if len(m.Allow) == 0 {
+		return true
+	}
+
+	for _, rule := range m.Allow {
+		if rule.matches(storage, host, rest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dotSegments reports whether path has "." or ".." parts
+func dotSegments(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if part == "." || part == ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r MediaRule) matches(storage, host, rest string) bool {
+	if r.Storage != "" && r.Storage != storage {
+		return false
+	}
+
+	if strings.HasPrefix(r.Host, "*.") {
+		if !strings.HasSuffix(host, r.Host[1:]) {
+			return false
+		}
+	} else if host != r.Host {
+		return false
+	}
+
+	return r.Prefix == "" || rest == r.Prefix || strings.HasPrefix(rest, r.Prefix+"/")
+}
@@ -0,0 +1,64 @@
+package imgwizard
+
+import "testing"
+
+func TestMediaMatcher(t *testing.T) {
+	allow, err := parseMediaRules("media.somesite.ua, *.cdn.somesite.ua,rem:static.somesite.ua/uploads,s3:products/2015")
+	if err != nil {
+		t.Fatalf("parseMediaRules returned %v", err)
+	}
+
+	deny, _ := parseMediaRules("*.cdn.somesite.ua/private")
+	matcher := MediaMatcher{Allow: allow, Deny: deny}
+
+	tests := []struct {
+		Storage string
+		Path    string
+		Allowed bool
+	}{
+		{"rem", "media.somesite.ua/uploads/image.jpg", true},
+		{"loc", "MEDIA.somesite.ua/image.jpg", true},
+		{"rem", "mediaXsomesiteYua.evil.net/image.jpg", false},
+		{"rem", "media.somesite.ua.evil.net/image.jpg", false},
+		{"rem", "img.cdn.somesite.ua/image.jpg", true},
+		{"rem", "cdn.somesite.ua/image.jpg", false},
+		{"rem", "evilcdn.somesite.ua/image.jpg", false},
+		{"rem", "img.cdn.somesite.ua/private/image.jpg", false},
+		{"rem", "img.cdn.somesite.ua/public/../private/image.jpg", false},
+		{"rem", "static.somesite.ua/uploads/image.jpg", true},
+		{"rem", "static.somesite.ua/uploads2/image.jpg", false},
+		{"az", "static.somesite.ua/uploads/image.jpg", false},
+		{"s3", "products/2015/02/image.jpg", true},
+		{"s3", "products/2016/image.jpg", false},
+		{"s3", "products/2015/..%2F2016/image.jpg", false},
+		{"rem", "evil.com/../media.somesite.ua/image.jpg", false},
+		{"rem", "media.somesite.ua/%2e%2e/image.jpg", false},
+		{"rem", "media.somesite.ua/./image.jpg", false},
+		{"rem", "media.somesite.ua/%2E/image.jpg", false},
+		{"s3", "other/../products/2015/image.jpg", false},
+		{"s3", "products/2015/a..b/image.jpg", true},
+		{"rem", "evil.com?.cdn.somesite.ua/image.jpg", false},
+		{"rem", "evil.com%23.cdn.somesite.ua/image.jpg", false},
+		{"rem", "media.somesite.ua@evil.com/image.jpg", false},
+	}
+
+	for i, test := range tests {
+		if allowed := matcher.Allowed(test.Storage, test.Path); allowed != test.Allowed {
+			t.Errorf("%d. Allowed(%s, %s) returned %v, needed %v", i, test.Storage, test.Path, allowed, test.Allowed)
+		}
+	}
+
+	if !(MediaMatcher{}).Allowed("rem", "any.host/image.jpg") {
+		t.Errorf("empty MediaMatcher denied media")
+	}
+
+	if (MediaMatcher{}).Allowed("loc", "uploads/%2e%2e/secret.jpg") {
+		t.Errorf("empty MediaMatcher allowed path with dot parts")
+	}
+
+	for _, list := range []string{"/uploads", "media.*.ua", "rem:"} {
+		if _, err := parseMediaRules(list); err == nil {
+			t.Errorf("parseMediaRules(%q) returned nil, needed error", list)
+		}
+	}
+}
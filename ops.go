@@ -0,0 +1,303 @@
+package imgwizard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/shifr/vips"
+)
+
+// CropRect is a crop area "x,y,w,h", every value is in pixels
+// or in percents of the original size, e.g. "10%,0,50%,100%"
+type CropRect struct {
+	Values  [4]float64
+	Percent [4]bool
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// parseCropRect parses "x,y,w,h" crop area
+func parseCropRect(s string) (CropRect, error) {
+	var rect CropRect
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return rect, fmt.Errorf("Invalid rect %q, x,y,w,h expected", s)
+	}
+
+	for i, part := range parts {
+		if strings.HasSuffix(part, "%") {
+			part = strings.TrimSuffix(part, "%")
+			rect.Percent[i] = true
+		}
+
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 {
+			return CropRect{}, fmt.Errorf("Invalid rect %q", s)
+		}
+		rect.Values[i] = value
+	}
+
+	if rect.Values[2] == 0 || rect.Values[3] == 0 {
+		return CropRect{}, fmt.Errorf("Invalid rect %q, empty area", s)
+	}
+
+	return rect, nil
+}
+
+// Empty reports whether crop area is not set
+func (r CropRect) Empty() bool {
+	return r.Values[2] == 0 || r.Values[3] == 0
+}
+
+// Resolve returns crop area in pixels for the original size,
+// area must be inside the original image
+func (r CropRect) Resolve(width, height int) (image.Rectangle, error) {
+	var px [4]int
+	size := [4]int{width, height, width, height}
+
+	for i, value := range r.Values {
+		if r.Percent[i] {
+			value = value * float64(size[i]) / 100
+		}
+		px[i] = int(math.Floor(value + 0.5))
+	}
+
+	rect := image.Rect(px[0], px[1], px[0]+px[2], px[1]+px[3])
+	if rect.Empty() || !rect.In(image.Rect(0, 0, width, height)) {
+		return rect, fmt.Errorf("Crop area %v is out of image %dx%d", rect, width, height)
+	}
+
+	return rect, nil
+}
+
+// TrimOptions is parsed "trim" param "[top-left|bottom-right][:tolerance]",
+// border colour is taken from the corner, tolerance is max channel difference
+type TrimOptions struct {
+	Enabled   bool
+	Corner    string
+	Tolerance int
+}
+
+// parseTrim parses "trim" param, e.g. "10", "bottom-right" or "top-left:10"
+func parseTrim(s string) (TrimOptions, error) {
+	trim := TrimOptions{Enabled: true, Corner: "top-left"}
+
+	for _, part := range strings.Split(s, ":") {
+		switch part {
+		case "", "top-left", "bottom-right":
+			if part != "" {
+				trim.Corner = part
+			}
+		default:
+			tolerance, err := strconv.Atoi(part)
+			if err != nil || tolerance < 0 || tolerance > 255 {
+				return TrimOptions{}, fmt.Errorf("Invalid trim %q", s)
+			}
+			trim.Tolerance = tolerance
+		}
+	}
+
+	return trim, nil
+}
+
+// resizeSteps are operations done by vips around resize,
+// Area of the original is cut out before resize
+type resizeSteps struct {
+	Area       image.Rectangle
+	Pad        bool
+	Flatten    bool
+	Background color.NRGBA
+}
+
+// Empty reports whether resize has no extra steps
+func (s resizeSteps) Empty() bool {
+	return s.Area.Empty() && !s.Pad && !s.Flatten
+}
+
+// needsArea reports whether part of the original must be cut out
+func (c *Context) needsArea() bool {
+	return !c.Rect.Empty() || c.Trim.Enabled
+}
+
+// resizeSteps returns crop area, padding and flattening steps of resize,
+// padding needs both width and height
+func (c *Context) resizeSteps(iType string) resizeSteps {
+	return resizeSteps{
+		Area:       c.Area,
+		Pad:        c.Pad && c.Options.Width > 0 && c.Options.Height > 0,
+		Flatten:    c.flattens(iType),
+		Background: c.Background,
+	}
+}
+
+// flattens reports whether transparency must be flattened
+// onto background, as output format has no alpha
+func (c *Context) flattens(iType string) bool {
+	return iType == PNG && outputType(iType, c) == JPEG
+}
+
+// cropArea returns area of the original left by manual crop and trim,
+// empty area is returned for the whole image. Image is decoded only for trim
+func cropArea(buf []byte, ctx *Context) (image.Rectangle, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return image.ZR, err
+	}
+
+	whole := image.Rect(0, 0, config.Width, config.Height)
+	area := whole
+	if !ctx.Rect.Empty() {
+		if area, err = ctx.Rect.Resolve(config.Width, config.Height); err != nil {
+			return image.ZR, &ClassifiedError{ErrBadParams, err}
+		}
+	}
+
+	if ctx.Trim.Enabled {
+		img, _, err := image.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return image.ZR, err
+		}
+
+		min := img.Bounds().Min
+		if img, err = subImage(img, area.Add(min)); err != nil {
+			return image.ZR, err
+		}
+
+		box := trimBox(img, ctx.Trim).Sub(min)
+		debug("Trimmed box %v of %v", box, area)
+		ctx.setHeader(TRIM_BOX_HEADER, fmt.Sprintf("%d,%d,%d,%d",
+			box.Min.X-area.Min.X, box.Min.Y-area.Min.Y, box.Dx(), box.Dy()))
+		area = box
+	}
+
+	if area == whole {
+		return image.ZR, nil
+	}
+
+	return area, nil
+}
+
+func subImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	sub, ok := img.(subImager)
+	if !ok {
+		return img, errors.New("Image can't be cropped")
+	}
+
+	return sub.SubImage(rect), nil
+}
+
+// trimBox returns image area left after removing borders
+// of near-uniform colour, whole image is returned if it's uniform
+func trimBox(img image.Image, trim TrimOptions) image.Rectangle {
+	bounds := img.Bounds()
+	corner := img.At(bounds.Min.X, bounds.Min.Y)
+	if trim.Corner == "bottom-right" {
+		corner = img.At(bounds.Max.X-1, bounds.Max.Y-1)
+	}
+
+	tolerance := uint32(trim.Tolerance)
+	r0, g0, b0, a0 := corner.RGBA()
+	similar := func(x, y int) bool {
+		r, g, b, a := img.At(x, y).RGBA()
+		return channelDiff(r, r0) <= tolerance && channelDiff(g, g0) <= tolerance &&
+			channelDiff(b, b0) <= tolerance && channelDiff(a, a0) <= tolerance
+	}
+	rowSimilar := func(y, left, right int) bool {
+		for x := left; x < right; x++ {
+			if !similar(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colSimilar := func(x, top, bottom int) bool {
+		for y := top; y < bottom; y++ {
+			if !similar(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top, bottom := bounds.Min.Y, bounds.Max.Y
+	for top < bottom && rowSimilar(top, bounds.Min.X, bounds.Max.X) {
+		top++
+	}
+	if top == bottom {
+		return bounds
+	}
+	for rowSimilar(bottom-1, bounds.Min.X, bounds.Max.X) {
+		bottom--
+	}
+
+	left, right := bounds.Min.X, bounds.Max.X
+	for colSimilar(left, top, bottom) {
+		left++
+	}
+	for colSimilar(right-1, top, bottom) {
+		right--
+	}
+
+	return image.Rect(left, top, right, bottom)
+}
+
+// channelDiff returns difference of 16-bit colour channels in 8-bit scale
+func channelDiff(a, b uint32) uint32 {
+	if a > b {
+		return (a - b) >> 8
+	}
+	return (b - a) >> 8
+}
+
+// areaThumbnail makes small decoded copy of the original area
+// fitting into size, whole image is used for empty area
+func areaThumbnail(orig []byte, area image.Rectangle, size int) (image.Image, error) {
+	if area.Empty() {
+		img, _, err := thumbnail(orig, size, DEFAULT_QUALITY)
+		return img, err
+	}
+
+	options := Options
+	options.Width = size
+	options.Height = size
+	options.Crop = false
+
+	thumb, err := vipsResize(orig, "png", options, resizeSteps{Area: area}, EncoderOptions{Compression: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(thumb))
+	return img, err
+}
+
+// thumbnail makes small decoded copy of the original fitting into size,
+// encoded thumbnail is returned too
+func thumbnail(orig []byte, size, quality int) (image.Image, []byte, error) {
+	options := Options
+	options.Width = size
+	options.Height = size
+	options.Crop = false
+	options.Quality = quality
+
+	thumb, err := vips.Resize(orig, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return img, thumb, nil
+}
@@ -0,0 +1,181 @@
+package imgwizard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCropRect(t *testing.T) {
+	tests := []struct {
+		Rect   string
+		Width  int
+		Height int
+		Result image.Rectangle
+		Valid  bool
+	}{
+		{"10,20,100,200", 500, 500, image.Rect(10, 20, 110, 220), true},
+		{"10%,0,50%,100%", 200, 100, image.Rect(20, 0, 120, 100), true},
+		{"0,0,500,500", 500, 500, image.Rect(0, 0, 500, 500), true},
+		{"450,0,100,100", 500, 500, image.Rectangle{}, false},
+		{"0,0,50%,101%", 500, 500, image.Rectangle{}, false},
+	}
+
+	for i, test := range tests {
+		rect, err := parseCropRect(test.Rect)
+		if err != nil {
+			t.Errorf("%d. parseCropRect returned error %v", i, err)
+			continue
+		}
+
+		result, err := rect.Resolve(test.Width, test.Height)
+		if test.Valid && (err != nil || result != test.Result) {
+			t.Errorf("%d. Resolve returned %v, %v, needed %v", i, result, err, test.Result)
+		}
+
+		if !test.Valid && err == nil {
+			t.Errorf("%d. Resolve returned %v, needed error", i, result)
+		}
+	}
+
+	for _, rect := range []string{"", "1,2,3", "a,b,c,d", "-1,0,10,10", "0,0,0,10"} {
+		if _, err := parseCropRect(rect); err == nil {
+			t.Errorf("parseCropRect(%q) returned nil, needed error", rect)
+		}
+	}
+}
+
+func TestTrimBox(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 80))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(10, 20, 60, 70), image.NewUniform(color.Black), image.ZP, draw.Src)
+	img.Set(95, 5, color.NRGBA{250, 250, 250, 255})
+
+	tests := []struct {
+		Trim   string
+		Result image.Rectangle
+	}{
+		{"", image.Rect(10, 5, 96, 70)},
+		{"10", image.Rect(10, 20, 60, 70)},
+		{"bottom-right:10", image.Rect(10, 20, 60, 70)},
+	}
+
+	for i, test := range tests {
+		trim, err := parseTrim(test.Trim)
+		if err != nil {
+			t.Errorf("%d. parseTrim returned error %v", i, err)
+			continue
+		}
+
+		if box := trimBox(img, trim); box != test.Result {
+			t.Errorf("%d. trimBox returned %v, needed %v", i, box, test.Result)
+		}
+	}
+
+	if box := trimBox(img.SubImage(image.Rect(0, 0, 5, 5)), TrimOptions{}); box != image.Rect(0, 0, 5, 5) {
+		t.Errorf("trimBox returned %v for uniform image, needed whole image", box)
+	}
+
+	for _, trim := range []string{"middle", "256", "top-left:x"} {
+		if _, err := parseTrim(trim); err == nil {
+			t.Errorf("parseTrim(%q) returned nil, needed error", trim)
+		}
+	}
+}
+
+func TestCropArea(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 80))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(10, 20, 60, 70), image.NewUniform(color.Black), image.ZP, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Rect   string
+		Trim   bool
+		Result image.Rectangle
+		Header string
+		Status int
+	}{
+		{"0,0,50%,50%", false, image.Rect(0, 0, 50, 40), "", http.StatusOK},
+		{"0,0,100%,100%", false, image.ZR, "", http.StatusOK},
+		{"", true, image.Rect(10, 20, 60, 70), "10,20,50,50", http.StatusOK},
+		{"5,10,60,50", true, image.Rect(10, 20, 60, 60), "5,10,50,40", http.StatusOK},
+		{"50,50,60,60", false, image.ZR, "", http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		ctx := &Context{}
+		if test.Rect != "" {
+			ctx.Rect, _ = parseCropRect(test.Rect)
+		}
+		if test.Trim {
+			ctx.Trim = TrimOptions{Enabled: true, Corner: "top-left"}
+		}
+
+		area, err := cropArea(buf.Bytes(), ctx)
+		if status := errStatus(err); area != test.Result || status != test.Status {
+			t.Errorf("%d. cropArea returned %v, %d, needed %v, %d", i, area, status, test.Result, test.Status)
+		}
+		if header := ctx.Header.Get(TRIM_BOX_HEADER); header != test.Header {
+			t.Errorf("%d. cropArea set trim box %q, needed %q", i, header, test.Header)
+		}
+	}
+}
+
+func TestResizeSteps(t *testing.T) {
+	tests := []struct {
+		Pad    bool
+		Width  int
+		Height int
+		Format string
+		IType  string
+		Result resizeSteps
+	}{
+		{true, 200, 200, "", JPEG, resizeSteps{Pad: true}},
+		{true, 200, 0, "", JPEG, resizeSteps{}},
+		{false, 200, 200, "jpeg", PNG, resizeSteps{Flatten: true}},
+		{true, 200, 200, "jpeg", PNG, resizeSteps{Pad: true, Flatten: true}},
+		{false, 200, 200, "png", PNG, resizeSteps{}},
+		{false, 200, 200, "", PNG, resizeSteps{}},
+	}
+
+	for i, test := range tests {
+		ctx := &Context{Pad: test.Pad, Format: test.Format}
+		ctx.Options.Width, ctx.Options.Height = test.Width, test.Height
+
+		if result := ctx.resizeSteps(test.IType); result != test.Result {
+			t.Errorf("%d. resizeSteps returned %+v, needed %+v", i, result, test.Result)
+		}
+	}
+}
+
+func TestApplyParamsErrors(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Status int
+	}{
+		{"rect=0,0,50%,50%&trim=top-left:10", http.StatusOK},
+		{"rect=0,0,50", http.StatusBadRequest},
+		{"rect=a,b,c,d", http.StatusBadRequest},
+		{"trim=middle", http.StatusBadRequest},
+		{"trim=top-left:x", http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		values, _ := url.ParseQuery(test.Query)
+		ctx := &Context{}
+
+		if status := errStatus(ctx.applyParams(values)); status != test.Status {
+			t.Errorf("%d. applyParams(%s) returned %d, needed %d", i, test.Query, status, test.Status)
+		}
+	}
+}
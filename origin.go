@@ -0,0 +1,649 @@
+package imgwizard
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Origin is a storage of original images, registered
+// in Origins under the storage prefix used in URL
+type Origin interface {
+	// Locate returns original image path for URL path
+	// and sub path the derivatives are cached under
+	Locate(ctx *Context, urlPath string) (path, cachePath string)
+	// Fetch returns original image reader and its metadata,
+	// when ctx.OrigMeta is set the fetch is conditional and
+	// ErrOriginNotModified error is returned for unchanged original
+	Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error)
+}
+
+// OriginMeta is original image metadata, every field is optional
+type OriginMeta struct {
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Version      string
+}
+
+// variantOrigin is origin whose originals depend on client request,
+// originals of different variants are cached apart
+type variantOrigin interface {
+	variant(ctx *Context) string
+}
+
+// Origins are registered storages by URL prefix
+var Origins = map[string]Origin{
+	"loc": localOrigin{},
+	"rem": remoteOrigin{},
+	"az":  azureOrigin{},
+	"s3":  s3Origin{},
+}
+
+var originPrefixExp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+var (
+	defaultClient = newHTTPClient(FetchTimeout, originGuard())
+	nodeClient    = newHTTPClient(FetchTimeout, nodeGuard(nil, ""))
+)
+
+// RegisterOrigin adds storage with URL prefix,
+// it must be called before settings are loaded
+func RegisterOrigin(prefix string, origin Origin) {
+	if !originPrefixExp.MatchString(prefix) {
+		panic(fmt.Sprintf("imgwizard: invalid origin prefix %q", prefix))
+	}
+
+	Origins[prefix] = origin
+}
+
+// originsExp returns regexp alternation of registered prefixes
+func originsExp() string {
+	var prefixes []string
+	for prefix := range Origins {
+		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
+	}
+	sort.Strings(prefixes)
+
+	return strings.Join(prefixes, "|")
+}
+
+// getOriginal returns original image of the context, it's taken from
+// originals cache if enabled, conditional fetch always goes to the storage
+func getOriginal(ctx *Context) ([]byte, error) {
+	if originals == nil {
+		return fetchOriginal(ctx)
+	}
+
+	if ctx.OrigMeta != nil {
+		image, err := fetchOriginal(ctx)
+		if err == nil {
+			originals.add(originalKey(ctx), image, ctx.OrigMeta, time.Now().Add(OriginalsTTL))
+		}
+		return image, err
+	}
+
+	return originals.get(ctx, fetchOriginal)
+}
+
+// fetchOriginal fetches original image from the context storage,
+// failed fetch is retried unless origin circuit breaker is open,
+// retries aren't started after FetchTimeout since the first fetch
+func fetchOriginal(ctx *Context) ([]byte, error) {
+	origin, ok := Origins[ctx.Storage]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage %s", ctx.Storage)
+	}
+
+	b := getBreaker(breakerName(ctx))
+	start := time.Now()
+
+	for retry := 0; ; retry++ {
+		if !b.allow() {
+			return nil, &ClassifiedError{ErrOriginUnavailable, fmt.Errorf("%s circuit breaker is open", b.name)}
+		}
+
+		image, err := fetchOriginalOnce(ctx, origin)
+		b.done(err)
+		if !retryable(err) || retry >= FetchRetries {
+			return image, err
+		}
+
+		delay := backoff(retry)
+		if time.Since(start)+delay >= FetchTimeout {
+			debug("No time left to retry fetch of %s", ctx.OrigImage)
+			return image, err
+		}
+
+		debug("Retrying fetch of %s in %s, reason - %s", ctx.OrigImage, delay, err)
+		b.retry()
+		time.Sleep(delay)
+	}
+}
+
+// fetchOriginalOnce fetches and reads original image
+func fetchOriginalOnce(ctx *Context, origin Origin) ([]byte, error) {
+	rc, meta, err := origin.Fetch(ctx, ctx.OrigImage)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rc.Close()
+
+	debug("Fetched %s original %s: %+v", ctx.Storage, ctx.OrigImage, meta)
+	ctx.OrigMeta = meta
+	if MaxOriginalBytes > 0 && meta != nil && meta.Size > MaxOriginalBytes {
+		return nil, &ClassifiedError{ErrOriginTooBig, fmt.Errorf("%d bytes", meta.Size)}
+	}
+
+	return readOriginal(rc)
+}
+
+// readOriginal reads original image, it's stopped
+// as soon as MaxOriginalBytes is exceeded
+func readOriginal(r io.Reader) ([]byte, error) {
+	if MaxOriginalBytes > 0 {
+		r = io.LimitReader(r, MaxOriginalBytes+1)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	if MaxOriginalBytes > 0 && int64(len(data)) > MaxOriginalBytes {
+		return nil, &ClassifiedError{ErrOriginTooBig, fmt.Errorf("more than %d bytes", MaxOriginalBytes)}
+	}
+
+	return data, nil
+}
+
+// getDefaultImage reads image returned when original is not found
+func getDefaultImage() ([]byte, error) {
+	return ioutil.ReadFile(Default404)
+}
+
+// splitContainer splits "container/key" path of cloud storages
+func splitContainer(path string) (string, string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// containerLocate unescapes path, container is not a part of cache path
+func containerLocate(urlPath string) (string, string) {
+	path, _ := url.QueryUnescape(urlPath)
+	_, key := splitContainer(urlPath)
+
+	return path, dirName(key)
+}
+
+// namedLocate unescapes path and adds prefix to it,
+// origin name is a part of cache path, so origins don't share cache
+func namedLocate(name, prefix, urlPath string) (string, string) {
+	path, _ := url.QueryUnescape(urlPath)
+	path = strings.TrimPrefix(pathpkg.Join("/", path), "/")
+
+	return pathpkg.Join(prefix, path), pathpkg.Join(name, dirName(path))
+}
+
+// dirName returns path without the last part
+func dirName(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+
+	return ""
+}
+
+// localOrigin fetches original image from file system,
+// built-in "loc" searches it in "-d" directories,
+// named one in its directory
+type localOrigin struct {
+	name   string
+	dir    string
+	prefix string
+}
+
+func (o localOrigin) Locate(ctx *Context, urlPath string) (string, string) {
+	if o.name == "" {
+		path, _ := url.QueryUnescape(urlPath)
+		return path, dirName(urlPath)
+	}
+
+	return namedLocate(o.name, o.prefix, urlPath)
+}
+
+func (o localOrigin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	var filePath string
+	var err error
+
+	if o.name == "" {
+		filePath, err = fileExists(path)
+	} else {
+		filePath, err = rootedPath(o.dir, path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &OriginMeta{}
+	if info, err := file.Stat(); err == nil {
+		meta.Size = info.Size()
+		meta.LastModified = info.ModTime()
+	}
+
+	if cached := ctx.OrigMeta; cached != nil && cached.Size == meta.Size &&
+		!cached.LastModified.IsZero() && !meta.LastModified.After(cached.LastModified) {
+		file.Close()
+		return nil, nil, &ClassifiedError{ErrOriginNotModified, fmt.Errorf("%s is not modified", path)}
+	}
+
+	return file, meta, nil
+}
+
+// remoteOrigin fetches original image by http url,
+// built-in "rem" takes host from the path
+type remoteOrigin struct {
+	name    string
+	url     string
+	prefix  string
+	client  *http.Client
+	header  http.Header
+	forward []string
+}
+
+func (o remoteOrigin) Locate(ctx *Context, urlPath string) (string, string) {
+	if o.name == "" {
+		scheme := ctx.Scheme
+		if scheme == "" {
+			scheme = GlobalSettings.Scheme
+		}
+
+		return fmt.Sprintf("%s://%s", scheme, urlPath), dirName(urlPath)
+	}
+
+	return o.namedURL(urlPath), o.cachePath(ctx, urlPath)
+}
+
+// namedURL returns URL of the original in named origin, path is escaped
+// back after unescaping with "+" kept, so it's fetched as requested
+func (o remoteOrigin) namedURL(urlPath string) string {
+	path, err := url.PathUnescape(urlPath)
+	if err != nil {
+		path = urlPath
+	}
+	path = strings.TrimPrefix(pathpkg.Join("/", path), "/")
+	path = (&url.URL{Path: pathpkg.Join(o.prefix, path)}).EscapedPath()
+
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(o.url, "/"), path)
+}
+
+// cachePath returns cache path of the original in named origin,
+// derivatives made with different forwarded headers are cached apart
+func (o remoteOrigin) cachePath(ctx *Context, urlPath string) string {
+	_, cachePath := namedLocate(o.name, o.prefix, urlPath)
+	if variant := o.variant(ctx); variant != "" {
+		cachePath = o.name + "#" + variant + strings.TrimPrefix(cachePath, o.name)
+	}
+
+	return cachePath
+}
+
+// variant returns hash of client request headers forwarded to origin,
+// it's empty if none of them is set
+func (o remoteOrigin) variant(ctx *Context) string {
+	hash := sha1.New()
+	found := false
+
+	for _, key := range o.forward {
+		key = http.CanonicalHeaderKey(key)
+		if values, ok := ctx.RequestHeader[key]; ok {
+			fmt.Fprintf(hash, "%s: %q\n", key, values)
+			found = true
+		}
+	}
+
+	if !found {
+		return ""
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (o remoteOrigin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	debug("Trying to fetch remote image: %s", path)
+
+	client := o.client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := fetchURL(client, path, conditionalHeader(o.requestHeader(ctx), ctx.OrigMeta))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &OriginMeta{
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	meta.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return resp.Body, meta, nil
+}
+
+// requestHeader returns origin headers with forwarded client
+// request headers, origin headers win
+func (o remoteOrigin) requestHeader(ctx *Context) http.Header {
+	if len(o.forward) == 0 || ctx.RequestHeader == nil {
+		return o.header
+	}
+
+	header := http.Header{}
+	for _, key := range o.forward {
+		if values, ok := ctx.RequestHeader[http.CanonicalHeaderKey(key)]; ok {
+			header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	for key, values := range o.header {
+		header[key] = values
+	}
+
+	return header
+}
+
+// conditionalHeader adds validators of cached original to request header
+func conditionalHeader(header http.Header, cached *OriginMeta) http.Header {
+	if cached == nil {
+		return header
+	}
+
+	conditional := http.Header{}
+	for key, values := range header {
+		conditional[key] = values
+	}
+
+	if cached.ETag != "" {
+		conditional.Set("If-None-Match", cached.ETag)
+	} else if !cached.LastModified.IsZero() {
+		conditional.Set("If-Modified-Since", cached.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	return conditional
+}
+
+// fetchURL makes GET request, only 200 response is returned
+func fetchURL(client *http.Client, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		err = fmt.Errorf("%s returned %s", path, resp.Status)
+		return nil, &ClassifiedError{statusKind(resp.StatusCode), err}
+	}
+
+	return resp, nil
+}
+
+// azureOrigin fetches original image from Azure Storage,
+// path of built-in "az" starts with container
+type azureOrigin struct {
+	name      string
+	container string
+	prefix    string
+	client    *storage.BlobStorageClient
+}
+
+func (o azureOrigin) Locate(ctx *Context, urlPath string) (string, string) {
+	if o.name == "" {
+		return containerLocate(urlPath)
+	}
+
+	return namedLocate(o.name, o.prefix, urlPath)
+}
+
+func (o azureOrigin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	container, blob, client := o.container, path, o.client
+
+	if o.name == "" {
+		if !ClientConfirmed {
+			return nil, nil, &ClassifiedError{ErrOriginRefused, errors.New("Azure client is not configured")}
+		}
+		container, blob = splitContainer(path)
+		client = &AzureClient
+	}
+
+	meta := &OriginMeta{}
+	if ctx.OrigMeta != nil {
+		// blob reading has no conditions, so ETag is checked beforehand,
+		// validators of the first fetch are empty and got on revalidation
+		props, err := client.GetBlobProperties(container, blob)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if cached := ctx.OrigMeta; cached != nil && cached.ETag != "" && cached.ETag == props.Etag {
+			return nil, nil, &ClassifiedError{ErrOriginNotModified, fmt.Errorf("%s is not modified", path)}
+		}
+
+		meta.Size = props.ContentLength
+		meta.ContentType = props.ContentType
+		meta.ETag = props.Etag
+		meta.LastModified, _ = http.ParseTime(props.LastModified)
+	}
+
+	debug("Trying to fetch azure image: '%s' from %s", blob, container)
+	rc, err := client.GetBlob(container, blob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rc, meta, nil
+}
+
+// s3Origin fetches original image from AWS S3 storage,
+// path of built-in "s3" starts with bucket
+type s3Origin struct {
+	name   string
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+func (o s3Origin) Locate(ctx *Context, urlPath string) (string, string) {
+	if o.name == "" {
+		return containerLocate(urlPath)
+	}
+
+	return namedLocate(o.name, o.prefix, urlPath)
+}
+
+func (o s3Origin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	bucket, key, client := o.bucket, path, o.client
+
+	if o.name == "" {
+		if !ClientConfirmed {
+			return nil, nil, &ClassifiedError{ErrOriginRefused, errors.New("AWS S3 client is not configured")}
+		}
+		bucket, key = splitContainer(path)
+		client = S3Client
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if cached := ctx.OrigMeta; cached != nil {
+		if cached.Version != "" {
+			// versioned object is revalidated by its latest version
+			head, err := client.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if aws.StringValue(head.VersionId) == cached.Version {
+				return nil, nil, &ClassifiedError{ErrOriginNotModified, fmt.Errorf("%s is not modified", path)}
+			}
+			input.VersionId = head.VersionId
+		} else if cached.ETag != "" {
+			input.IfNoneMatch = aws.String(cached.ETag)
+		} else if !cached.LastModified.IsZero() {
+			input.IfModifiedSince = aws.Time(cached.LastModified)
+		}
+	}
+
+	debug("Trying to fetch S3 image: '%s' from %s", key, bucket)
+	resp, err := client.GetObject(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &OriginMeta{
+		Size:        aws.Int64Value(resp.ContentLength),
+		ContentType: aws.StringValue(resp.ContentType),
+		ETag:        aws.StringValue(resp.ETag),
+	}
+	// "null" is version of objects in unversioned bucket
+	if version := aws.StringValue(resp.VersionId); version != "null" {
+		meta.Version = version
+	}
+	if resp.LastModified != nil {
+		meta.LastModified = *resp.LastModified
+	}
+
+	return resp.Body, meta, nil
+}
+
+// newOrigin makes origin from configuration,
+// credentials are taken from environment if not set
+func newOrigin(name string, cfg OriginConfig) (Origin, error) {
+	timeout := FetchTimeout
+	if cfg.Timeout != "" {
+		timeout, _ = time.ParseDuration(cfg.Timeout)
+	}
+	var host string
+	if u, err := url.Parse(cfg.URL); err == nil {
+		host = u.Host
+		if h, _, err := net.SplitHostPort(u.Host); err == nil {
+			host = h
+		}
+	}
+	client := newHTTPClient(timeout, originGuard(host))
+
+	switch cfg.Type {
+	case "loc":
+		return localOrigin{name: name, dir: cfg.Directory, prefix: cfg.Prefix}, nil
+	case "rem":
+		header := http.Header{}
+		for key, value := range cfg.Headers {
+			header.Set(key, value)
+		}
+
+		if cfg.Token != "" {
+			header.Set("Authorization", "Bearer "+cfg.Token)
+		} else if cfg.Username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+			header.Set("Authorization", "Basic "+credentials)
+		}
+
+		// origin headers aren't sent to other hosts on redirect
+		redirect := client.CheckRedirect
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host {
+				for key := range header {
+					req.Header.Del(key)
+				}
+				for _, key := range cfg.ForwardHeaders {
+					req.Header.Del(key)
+				}
+			}
+			return redirect(req, via)
+		}
+
+		return remoteOrigin{name: name, url: cfg.URL, prefix: cfg.Prefix,
+			client: client, header: header, forward: cfg.ForwardHeaders}, nil
+	case "az":
+		account, key := cfg.AccessKey, cfg.SecretKey
+		if account == "" {
+			account, key = os.Getenv(AZURE_ACCOUNT_NAME), os.Getenv(AZURE_ACCOUNT_KEY)
+		}
+
+		basic, err := storage.NewBasicClient(account, key)
+		if err != nil {
+			return nil, err
+		}
+		blobs := basic.GetBlobService()
+
+		return azureOrigin{name: name, container: cfg.Bucket, prefix: cfg.Prefix,
+			client: &blobs}, nil
+	case "s3":
+		config := &aws.Config{HTTPClient: client}
+
+		config.Region = aws.String(cfg.Region)
+		if cfg.Region == "" {
+			config.Region = aws.String(os.Getenv(AWS_REGION))
+		}
+
+		if cfg.AccessKey != "" {
+			config.Credentials = credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, "")
+		} else {
+			config.Credentials = credentials.NewStaticCredentials(
+				os.Getenv(AWS_ACCESS_KEY_ID), os.Getenv(AWS_SECRET_ACCESS_KEY), "")
+		}
+
+		return s3Origin{name: name, bucket: cfg.Bucket, prefix: cfg.Prefix,
+			client: s3.New(session.New(config))}, nil
+	}
+
+	return nil, fmt.Errorf("origin %q: unknown type %q", name, cfg.Type)
+}
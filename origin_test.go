@@ -0,0 +1,297 @@
+package imgwizard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memOrigin map[string][]byte
+
+func (m memOrigin) Locate(ctx *Context, urlPath string) (string, string) {
+	return urlPath, "mem"
+}
+
+func (m memOrigin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	data, ok := m[path]
+	if !ok {
+		return nil, nil, io.EOF
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), &OriginMeta{Size: int64(len(data))}, nil
+}
+
+// fakeOrigin returns path as original with path ETag, "missing.jpg" is not
+// found, "denied.jpg" is denied, first failures fetches fail, fetches are counted
+type fakeOrigin struct {
+	fetches  *int32
+	failures *int32
+	delay    time.Duration
+}
+
+func (o fakeOrigin) Locate(ctx *Context, urlPath string) (string, string) {
+	return urlPath, "fake"
+}
+
+func (o fakeOrigin) Fetch(ctx *Context, path string) (io.ReadCloser, *OriginMeta, error) {
+	if o.fetches != nil {
+		atomic.AddInt32(o.fetches, 1)
+	}
+	time.Sleep(o.delay)
+
+	if o.failures != nil && atomic.AddInt32(o.failures, -1) >= 0 {
+		return nil, nil, errors.New("connection reset")
+	}
+	if path == "missing.jpg" {
+		return nil, nil, os.ErrNotExist
+	}
+	if path == "denied.jpg" {
+		return nil, nil, &ClassifiedError{ErrOriginDenied, errors.New("denied.jpg is out of root")}
+	}
+
+	return ioutil.NopCloser(bytes.NewReader([]byte(path))), &OriginMeta{ETag: path}, nil
+}
+
+func TestRegisterOrigin(t *testing.T) {
+	RegisterOrigin("mem", memOrigin{"logo.png": []byte("png")})
+	defer delete(Origins, "mem")
+
+	Mark = "images"
+	CacheDir = "/tmp/imgwizard"
+	exp := GlobalSettings.UrlExp
+	GlobalSettings.UrlExp = urlExp("[0-9]*x[0-9]*")
+	defer func() { GlobalSettings.UrlExp = exp }()
+
+	req, _ := http.NewRequest("GET", "http://localhost/images/mem/100x100/logo.png", nil)
+	if !GlobalSettings.UrlExp.MatchString(req.URL.EscapedPath()) {
+		t.Fatalf("URL regexp %v doesn't match registered origin", GlobalSettings.UrlExp)
+	}
+
+	context := Context{}
+	if err := context.Fill(req); err != nil {
+		t.Fatalf("Fill returned %v", err)
+	}
+
+	if context.OrigImage != "logo.png" || context.CachePath != "/tmp/imgwizard/mem/logo_100x100.png" {
+		t.Errorf("Fill returned %v, %v", context.OrigImage, context.CachePath)
+	}
+
+	if data, err := getOriginal(&context); err != nil || string(data) != "png" {
+		t.Errorf("getOriginal returned %q, %v, needed %q", data, err, "png")
+	}
+}
+
+func TestContainerLocate(t *testing.T) {
+	tests := []struct {
+		Storage   string
+		Path      string
+		OrigImage string
+		CachePath string
+	}{
+		{"s3", "bucket/uploads/a%20b.jpg", "bucket/uploads/a b.jpg", "/tmp/imgwizard/uploads/a b_10x10.jpg"},
+		{"az", "container/dir/a.jpg", "container/dir/a.jpg", "/tmp/imgwizard/dir/a_10x10.jpg"},
+		{"rem", "media.somesite.ua/a.jpg", "http://media.somesite.ua/a.jpg", "/tmp/imgwizard/media.somesite.ua/a_10x10.jpg"},
+	}
+
+	CacheDir = "/tmp/imgwizard"
+	GlobalSettings.Scheme = "http"
+
+	for i, test := range tests {
+		context := Context{Storage: test.Storage, Path: test.Path}
+		context.Options.Width = 10
+		context.Options.Height = 10
+
+		context.makeCachePath()
+
+		if context.OrigImage != test.OrigImage || context.CachePath != test.CachePath {
+			t.Errorf("%d. makeCachePath returned %v, %v, needed %v, %v", i,
+				context.OrigImage, context.CachePath, test.OrigImage, test.CachePath)
+		}
+	}
+}
+
+func TestNamedOrigin(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Config    OriginConfig
+		Path      string
+		OrigImage string
+		CachePath string
+	}{
+		{
+			"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua/", Prefix: "uploads"},
+			"images/a%20b.jpg", "https://media.somesite.ua/uploads/images/a%20b.jpg", "/tmp/imgwizard/media/images/a b_10x10.jpg",
+		},
+		{
+			"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua/", Prefix: "uploads"},
+			"images/a+b%3Fc%23d.jpg", "https://media.somesite.ua/uploads/images/a+b%3Fc%23d.jpg", "/tmp/imgwizard/media/images/a b?c#d_10x10.jpg",
+		},
+		{
+			"media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua/"},
+			"images/a?b#c.jpg", "https://media.somesite.ua/images/a%3Fb%23c.jpg", "/tmp/imgwizard/media/images/a?b#c_10x10.jpg",
+		},
+		{
+			"archive", OriginConfig{Type: "s3", Bucket: "archive"},
+			"2015/02/a.jpg", "2015/02/a.jpg", "/tmp/imgwizard/archive/2015/02/a_10x10.jpg",
+		},
+		{
+			"uploads", OriginConfig{Type: "loc", Directory: "/var/uploads", Prefix: "v1"},
+			"../../etc/a.jpg", "v1/etc/a.jpg", "/tmp/imgwizard/uploads/etc/a_10x10.jpg",
+		},
+	}
+
+	CacheDir = "/tmp/imgwizard"
+
+	for i, test := range tests {
+		origin, err := newOrigin(test.Name, test.Config)
+		if err != nil {
+			t.Fatalf("%d. newOrigin returned %v", i, err)
+		}
+		RegisterOrigin(test.Name, origin)
+		defer delete(Origins, test.Name)
+
+		context := Context{Storage: test.Name, Path: test.Path}
+		context.Options.Width = 10
+		context.Options.Height = 10
+
+		context.makeCachePath()
+
+		if context.OrigImage != test.OrigImage || context.CachePath != test.CachePath {
+			t.Errorf("%d. makeCachePath returned %v, %v, needed %v, %v", i,
+				context.OrigImage, context.CachePath, test.OrigImage, test.CachePath)
+		}
+	}
+}
+
+func TestRemoteOriginHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		rw.Write([]byte("image"))
+	}))
+	defer server.Close()
+
+	request := http.Header{}
+	request.Set("Cookie", "session=1")
+	request.Set("X-Tenant", "client")
+	request.Set("X-Private", "secret")
+
+	tests := []struct {
+		Config OriginConfig
+		Header map[string]string
+	}{
+		{
+			OriginConfig{Type: "rem", URL: server.URL},
+			map[string]string{"User-Agent": UserAgent, "Authorization": "", "Cookie": ""},
+		},
+		{
+			OriginConfig{Type: "rem", URL: server.URL, Token: "token", ForwardHeaders: []string{"cookie", "X-Tenant"},
+				Headers: map[string]string{"X-Tenant": "static"}},
+			map[string]string{"Authorization": "Bearer token", "Cookie": "session=1", "X-Tenant": "static", "X-Private": ""},
+		},
+		{
+			OriginConfig{Type: "rem", URL: server.URL, Username: "user", Password: "pass",
+				Headers: map[string]string{"User-Agent": "shop/1.0"}},
+			map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "User-Agent": "shop/1.0"},
+		},
+	}
+
+	for i, test := range tests {
+		origin, err := newOrigin("media", test.Config)
+		if err != nil {
+			t.Fatalf("%d. newOrigin returned %v", i, err)
+		}
+
+		rc, _, err := origin.Fetch(&Context{RequestHeader: request}, server.URL+"/image.jpg")
+		if err != nil {
+			t.Fatalf("%d. Fetch returned %v", i, err)
+		}
+		rc.Close()
+
+		for key, value := range test.Header {
+			if received.Get(key) != value {
+				t.Errorf("%d. origin received %s: %q, needed %q", i, key, received.Get(key), value)
+			}
+		}
+	}
+}
+
+func TestRemoteOriginRedirect(t *testing.T) {
+	var received http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		rw.Write([]byte("image"))
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, other.URL+"/image.jpg", http.StatusFound)
+	}))
+	defer server.Close()
+
+	origin, err := newOrigin("media", OriginConfig{Type: "rem", URL: server.URL, ForwardHeaders: []string{"X-Tenant"},
+		Headers: map[string]string{"X-Api-Key": "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := http.Header{}
+	request.Set("X-Tenant", "client")
+
+	rc, _, err := origin.Fetch(&Context{RequestHeader: request}, server.URL+"/image.jpg")
+	if err != nil {
+		t.Fatalf("Fetch returned %v", err)
+	}
+	rc.Close()
+
+	for _, key := range []string{"X-Api-Key", "X-Tenant"} {
+		if value := received.Get(key); value != "" {
+			t.Errorf("other host received %s: %q", key, value)
+		}
+	}
+}
+
+func TestForwardedHeadersCache(t *testing.T) {
+	origin, err := newOrigin("media", OriginConfig{Type: "rem", URL: "https://media.somesite.ua", ForwardHeaders: []string{"Cookie"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterOrigin("media", origin)
+	defer delete(Origins, "media")
+
+	CacheDir = "/tmp/imgwizard"
+
+	keys := func(cookie string) (string, string) {
+		context := Context{Storage: "media", Path: "images/a.jpg", RequestHeader: http.Header{}}
+		if cookie != "" {
+			context.RequestHeader.Set("Cookie", cookie)
+		}
+		context.Options.Width = 10
+		context.Options.Height = 10
+
+		context.makeCachePath()
+		return context.CachePath, originalKey(&context)
+	}
+
+	cachePath, origKey := keys("")
+	if cachePath != "/tmp/imgwizard/media/images/a_10x10.jpg" || origKey != "media:https://media.somesite.ua/images/a.jpg" {
+		t.Errorf("cache keys without forwarded headers are %v, %v", cachePath, origKey)
+	}
+
+	cachePath1, origKey1 := keys("session=1")
+	cachePath2, origKey2 := keys("session=2")
+	if cachePath1 == cachePath || cachePath1 == cachePath2 || origKey1 == origKey || origKey1 == origKey2 {
+		t.Errorf("different cookies share cache keys %v, %v and %v, %v", cachePath1, origKey1, cachePath2, origKey2)
+	}
+
+	if cachePath, origKey := keys("session=1"); cachePath != cachePath1 || origKey != origKey1 {
+		t.Errorf("the same cookie gives cache keys %v, %v, needed %v, %v", cachePath, origKey, cachePath1, origKey1)
+	}
+}
@@ -0,0 +1,268 @@
+package imgwizard
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shifr/imgwizard/cache"
+)
+
+var (
+	// OriginalsMemBytes is max size of originals cached in memory, 0 disables it
+	OriginalsMemBytes int64
+	// OriginalsDir is directory of originals cached on disk, empty disables it
+	OriginalsDir string
+	// OriginalsDiskBytes is max size of originals cached on disk
+	OriginalsDiskBytes = int64(1 << 30)
+	// OriginalsTTL is lifetime of cached original
+	OriginalsTTL = 10 * time.Minute
+
+	originals *originalsCache
+)
+
+const ORIGINAL_FILE_SUFFIX = ".orig"
+
+// originalsCache keeps fetched originals, so every derivative
+// of the same original is made with a single fetch
+type originalsCache struct {
+	memory *lruCache
+	disk   *lruCache
+
+	mu    sync.Mutex
+	calls map[string]*originalCall
+}
+
+// originalCall is in-flight fetch of original waited by concurrent requests
+type originalCall struct {
+	done  chan struct{}
+	image []byte
+	meta  *OriginMeta
+	err   error
+}
+
+// newOriginalsCache returns nil if neither memory nor disk cache is enabled,
+// stale originals of previous run are removed from the disk cache directory
+func newOriginalsCache() (*originalsCache, error) {
+	if OriginalsMemBytes <= 0 && OriginalsDir == "" {
+		return nil, nil
+	}
+
+	c := &originalsCache{calls: map[string]*originalCall{}}
+
+	if OriginalsMemBytes > 0 {
+		c.memory = newLRUCache(OriginalsMemBytes, "")
+	}
+
+	if OriginalsDir != "" {
+		if err := os.MkdirAll(OriginalsDir, 0777); err != nil {
+			return nil, err
+		}
+
+		stale, _ := filepath.Glob(filepath.Join(OriginalsDir, "*"+ORIGINAL_FILE_SUFFIX))
+		temp, _ := filepath.Glob(filepath.Join(OriginalsDir, "*"+ORIGINAL_FILE_SUFFIX+".tmp*"))
+		for _, name := range append(stale, temp...) {
+			os.Remove(name)
+		}
+
+		c.disk = newLRUCache(OriginalsDiskBytes, OriginalsDir)
+	}
+
+	return c, nil
+}
+
+// originalKey is cache key of context original,
+// variant is added for origins depending on client request
+func originalKey(ctx *Context) string {
+	key := ctx.Storage + ":" + ctx.OrigImage
+	if o, ok := Origins[ctx.Storage].(variantOrigin); ok {
+		if variant := o.variant(ctx); variant != "" {
+			key += "#" + variant
+		}
+	}
+
+	return key
+}
+
+// get returns cached original or fetches it, concurrent
+// requests of the same original share the fetch
+func (c *originalsCache) get(ctx *Context, fetch func(*Context) ([]byte, error)) ([]byte, error) {
+	key := originalKey(ctx)
+
+	if image, meta, ok := c.lookup(key); ok {
+		debug("Original found in cache: %s", key)
+		ctx.OrigMeta = meta
+		return image, nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		debug("Waiting for original fetch: %s", key)
+		<-call.done
+		ctx.OrigMeta = call.meta
+		return call.image, call.err
+	}
+
+	call := &originalCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.image, call.err = fetch(ctx)
+	call.meta = ctx.OrigMeta
+	if call.err == nil {
+		c.add(key, call.image, call.meta, time.Now().Add(OriginalsTTL))
+	}
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.image, call.err
+}
+
+// lookup checks memory, then disk, original found on disk
+// is kept in memory till the same expiry
+func (c *originalsCache) lookup(key string) ([]byte, *OriginMeta, bool) {
+	if c.memory != nil {
+		if entry, ok := c.memory.get(key); ok {
+			return entry.image, entry.meta, true
+		}
+	}
+
+	if c.disk != nil {
+		if entry, ok := c.disk.get(key); ok {
+			if c.memory != nil {
+				c.memory.add(key, entry.image, entry.meta, entry.expires)
+			}
+			return entry.image, entry.meta, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// add keeps original in every enabled cache
+func (c *originalsCache) add(key string, image []byte, meta *OriginMeta, expires time.Time) {
+	if c.memory != nil {
+		c.memory.add(key, image, meta, expires)
+	}
+
+	if c.disk != nil {
+		c.disk.add(key, image, meta, expires)
+	}
+}
+
+// lruCache is size-bounded cache with least recently used eviction,
+// values are kept in memory or in files of dir
+type lruCache struct {
+	max int64
+	dir string
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	image   []byte
+	meta    *OriginMeta
+	size    int64
+	expires time.Time
+}
+
+func newLRUCache(max int64, dir string) *lruCache {
+	return &lruCache{max: max, dir: dir, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// fileName returns file of disk cache entry
+func (c *lruCache) fileName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+ORIGINAL_FILE_SUFFIX)
+}
+
+// get returns copy of entry with image read from disk cache file
+func (c *lruCache) get(key string) (*lruEntry, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	entry := *el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return &entry, true
+	}
+
+	image, err := ioutil.ReadFile(c.fileName(key))
+	if err != nil {
+		debug("Can't read cached original, reason - %s", err)
+		return nil, false
+	}
+	entry.image = image
+
+	return &entry, true
+}
+
+// add keeps image till expires, disk cache file is replaced
+// atomically, so concurrent get never reads partial image
+func (c *lruCache) add(key string, image []byte, meta *OriginMeta, expires time.Time) {
+	size := int64(len(image))
+	if size > c.max {
+		return
+	}
+
+	if c.dir != "" {
+		if err := (&cache.Cache{}).FSReplace(c.fileName(key), image); err != nil {
+			warning("Can't cache original, reason - %s", err)
+			return
+		}
+		image = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*lruEntry).size
+		c.ll.Remove(el)
+	}
+
+	entry := &lruEntry{key: key, image: image, meta: meta, size: size, expires: expires}
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += size
+
+	for c.size > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove evicts entry, mutex must be held
+func (c *lruCache) remove(el *list.Element) {
+	entry := el.Value.(*lruEntry)
+
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+
+	if c.dir != "" {
+		os.Remove(c.fileName(entry.key))
+	}
+}
@@ -0,0 +1,117 @@
+package imgwizard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expires := time.Now().Add(time.Minute)
+	for _, c := range []*lruCache{newLRUCache(10, ""), newLRUCache(10, dir)} {
+		c.add("a", []byte("aaaa"), nil, expires)
+		c.add("b", []byte("bbbb"), nil, expires)
+		c.get("a")
+		c.add("c", []byte("cccc"), nil, expires)
+		c.add("big", []byte("too big image"), nil, expires)
+
+		for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "big": false} {
+			entry, ok := c.get(key)
+			if ok != cached || (ok && string(entry.image) != key+key+key+key) {
+				t.Errorf("lruCache (dir %q) get(%q) returned %v, %v, needed %v", c.dir, key, entry, ok, cached)
+			}
+		}
+
+		if c.size != 8 {
+			t.Errorf("lruCache (dir %q) size is %d, needed 8", c.dir, c.size)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("disk lruCache keeps %d files, needed 2", len(files))
+	}
+
+	c := newLRUCache(10, "")
+	c.add("a", []byte("a"), nil, time.Now().Add(-time.Second))
+	if _, ok := c.get("a"); ok {
+		t.Errorf("lruCache returned expired entry")
+	}
+}
+
+func TestOriginalsPromotion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &originalsCache{memory: newLRUCache(10, ""), disk: newLRUCache(10, dir)}
+	expires := time.Now().Add(time.Minute)
+	c.disk.add("a", []byte("a"), nil, expires)
+
+	if image, _, ok := c.lookup("a"); !ok || string(image) != "a" {
+		t.Fatalf("lookup returned %q, %v, needed original from disk", image, ok)
+	}
+
+	if entry, ok := c.memory.get("a"); !ok || !entry.expires.Equal(expires) {
+		t.Errorf("promoted original expires %v, needed %v", entry, expires)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(files) != 0 {
+		t.Errorf("disk lruCache left temporary files %v", files)
+	}
+}
+
+func TestOriginalsCache(t *testing.T) {
+	var fetches int32
+	RegisterOrigin("counting", fakeOrigin{fetches: &fetches, delay: 50 * time.Millisecond})
+	defer delete(Origins, "counting")
+
+	OriginalsMemBytes = 1 << 20
+	defer func() { OriginalsMemBytes = 0 }()
+
+	var err error
+	if originals, err = newOriginalsCache(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { originals = nil }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ctx := &Context{Storage: "counting", OrigImage: "image.jpg"}
+			image, err := getOriginal(ctx)
+			if string(image) != "image.jpg" || err != nil || ctx.OrigMeta == nil || ctx.OrigMeta.ETag != "image.jpg" {
+				t.Errorf("%d. getOriginal returned %q, %v, %+v", i, image, err, ctx.OrigMeta)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	getOriginal(&Context{Storage: "counting", OrigImage: "image.jpg"})
+	if fetches != 1 {
+		t.Errorf("original was fetched %d times, needed 1", fetches)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := getOriginal(&Context{Storage: "counting", OrigImage: "missing.jpg"})
+		if e, ok := err.(*ClassifiedError); !ok || e.Kind != ErrOriginNotFound {
+			t.Errorf("getOriginal of missing original returned %v", err)
+		}
+	}
+	if fetches != 3 {
+		t.Errorf("errors are cached, fetched %d times, needed 3", fetches)
+	}
+}
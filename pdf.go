@@ -0,0 +1,53 @@
+package imgwizard
+
+import "math"
+
+const (
+	PDF             = "application/pdf"
+	PDF_DEFAULT_DPI = 72
+	PDF_MAX_PIXELS  = SVG_MAX_PIXELS
+)
+
+var PDFMaxDPI = 300
+
+// rasterizePDF renders requested page of PDF to PNG large enough
+// for the requested size, but not with more than PDFMaxDPI
+// and PDF_MAX_PIXELS
+func rasterizePDF(buf []byte, ctx *Context) ([]byte, error) {
+	page := ctx.Page
+	if page == 0 {
+		page = 1
+	}
+
+	width, height, err := vipsPDFSize(buf, page-1)
+	if err != nil {
+		return nil, err
+	}
+
+	dpi := pdfDPI(width, height, ctx)
+	debug("Rasterizing PDF page %d of %dx%d with %g dpi", page, width, height, dpi)
+	return vipsRasterizePDF(buf, page-1, dpi)
+}
+
+// pdfDPI returns DPI to rasterize page of width x height points with
+func pdfDPI(width, height int, ctx *Context) float64 {
+	dpi := float64(ctx.Density)
+	if dpi == 0 {
+		dpi = PDF_DEFAULT_DPI
+	}
+
+	if width > 0 && height > 0 {
+		dpi = math.Max(dpi, float64(ctx.Options.Width*PDF_DEFAULT_DPI)/float64(width))
+		dpi = math.Max(dpi, float64(ctx.Options.Height*PDF_DEFAULT_DPI)/float64(height))
+	}
+	dpi = math.Min(dpi, float64(PDFMaxDPI))
+
+	if width > 0 && height > 0 {
+		scale := dpi / PDF_DEFAULT_DPI
+		if float64(width*height)*scale*scale > PDF_MAX_PIXELS {
+			dpi = PDF_DEFAULT_DPI * math.Sqrt(PDF_MAX_PIXELS/float64(width*height))
+		}
+	}
+
+	return dpi
+}
@@ -0,0 +1,29 @@
+package imgwizard
+
+import "testing"
+
+func TestPDFDPI(t *testing.T) {
+	tests := []struct {
+		Width   int
+		Height  int
+		Density int
+		Size    [2]int
+		Result  float64
+	}{
+		{595, 842, 0, [2]int{0, 0}, 72},
+		{595, 842, 150, [2]int{0, 0}, 150},
+		{595, 842, 0, [2]int{1190, 0}, 144},
+		{595, 842, 1000, [2]int{0, 0}, 300},
+		{14400, 14400, 0, [2]int{0, 0}, 25},
+		{0, 0, 0, [2]int{2000, 2000}, 72},
+	}
+
+	for i, test := range tests {
+		ctx := &Context{Density: test.Density}
+		ctx.Options.Width, ctx.Options.Height = test.Size[0], test.Size[1]
+
+		if result := pdfDPI(test.Width, test.Height, ctx); result != test.Result {
+			t.Errorf("%d. pdfDPI returned %g, needed %g", i, result, test.Result)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package imgwizard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	PLACEHOLDER_SIZE     = 32
+	PLACEHOLDER_MAX_SIZE = 100
+	PLACEHOLDER_QUALITY  = 40
+	BASE83_CHARS         = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// Placeholder is a low-quality image placeholder of the original
+type Placeholder struct {
+	BlurHash string `json:"blurhash"`
+	LQIP     string `json:"lqip"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// FetchPlaceholder serves placeholder of the original:
+// JSON by default, BlurHash or data URI for "format=blurhash|datauri"
+func FetchPlaceholder(rw http.ResponseWriter, req *http.Request) {
+	serveMeta(rw, req, GlobalSettings.PlaceholderExp, makePlaceholder, writePlaceholder)
+}
+
+func writePlaceholder(rw http.ResponseWriter, ctx *Context, data []byte) {
+	var placeholder Placeholder
+	var text string
+
+	switch ctx.Format {
+	case "blurhash", "datauri":
+		if err := json.Unmarshal(data, &placeholder); err != nil {
+			http.Error(rw, "Invalid placeholder", http.StatusInternalServerError)
+			return
+		}
+		text = placeholder.BlurHash
+		if ctx.Format == "datauri" {
+			text = placeholder.LQIP
+		}
+	default:
+		writeJSON(rw, data)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(text)))
+	rw.Write([]byte(text))
+}
+
+// makePlaceholder makes JSON with BlurHash and data URI of tiny thumbnail,
+// "size" (default 32) and "components" (default 4x3) params are supported
+func makePlaceholder(orig []byte, ctx *Context) ([]byte, error) {
+	var placeholder Placeholder
+	var xComponents, yComponents = 4, 3
+
+	values := ctx.Values
+	size, err := strconv.Atoi(values.Get("size"))
+	if err != nil || size <= 0 || size > PLACEHOLDER_MAX_SIZE {
+		size = PLACEHOLDER_SIZE
+	}
+
+	if components := values.Get("components"); components != "" {
+		fmt.Sscanf(components, "%dx%d", &xComponents, &yComponents)
+		if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+			return nil, fmt.Errorf("Invalid components %q", components)
+		}
+	}
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(orig)); err == nil {
+		placeholder.Width = config.Width
+		placeholder.Height = config.Height
+	}
+
+	quality := ctx.Options.Quality
+	if values.Get("q") == "" {
+		quality = PLACEHOLDER_QUALITY
+	}
+
+	img, thumb, err := thumbnail(orig, size, quality)
+	if err != nil {
+		return nil, err
+	}
+
+	placeholder.BlurHash = blurHash(img, xComponents, yComponents)
+	placeholder.LQIP = fmt.Sprintf("data:%s;base64,%s",
+		http.DetectContentType(thumb), base64.StdEncoding.EncodeToString(thumb))
+
+	return json.Marshal(placeholder)
+}
+
+// blurHash encodes image with BlurHash algorithm, see https://blurha.sh
+func blurHash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					factor[0] += basis * sRGBToLinear(c.R)
+					factor[1] += basis * sRGBToLinear(c.G)
+					factor[2] += basis * sRGBToLinear(c.B)
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			for k := range factor {
+				factor[k] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := encodeBase83((xComponents-1)+(yComponents-1)*9, 1)
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash += encodeBase83(quantisedMaximum, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	dc := factors[0]
+	hash += encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, factor := range factors[1:] {
+		var quant [3]int
+		for k, value := range factor {
+			quant[k] = int(math.Max(0, math.Min(18,
+				math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash += encodeBase83(quant[0]*19*19+quant[1]*19+quant[2], 2)
+	}
+
+	return hash
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = BASE83_CHARS[digit]
+	}
+
+	return string(result)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,33 @@
+package imgwizard
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	white := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(white, white.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+
+	if hash := blurHash(white, 1, 1); hash != "00TSUA" {
+		t.Errorf("blurHash returned %v, needed %v", hash, "00TSUA")
+	}
+
+	gradient := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 24; y++ {
+			gradient.Set(x, y, color.NRGBA{uint8(x * 8), uint8(y * 10), 128, 255})
+		}
+	}
+
+	hash := blurHash(gradient, 4, 3)
+	if len(hash) != 28 {
+		t.Errorf("blurHash returned %v of length %d, needed 28", hash, len(hash))
+	}
+
+	if hash[0] != BASE83_CHARS[3+2*9] {
+		t.Errorf("blurHash returned %v, size flag doesn't match 4x3 components", hash)
+	}
+}
@@ -0,0 +1,153 @@
+package imgwizard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"strconv"
+
+	"github.com/shifr/goquant"
+)
+
+const (
+	QUANTIZE_COLORS  = 256
+	QUANTIZE_SAMPLES = 256
+)
+
+var QuantizeModes = []string{"off", "on", "auto"}
+
+// QuantizeOptions control PNG quantization: "on" always quantizes,
+// "auto" only if image has at most Colors colours including alpha
+type QuantizeOptions struct {
+	Mode   string
+	Colors int
+	Dither bool
+}
+
+// parseQuantizeOptions parses quantization params,
+// server defaults are used for absent or invalid values
+func parseQuantizeOptions(values url.Values) QuantizeOptions {
+	q := QuantizeOptions{Mode: QuantizeMode, Colors: QUANTIZE_COLORS, Dither: true}
+
+	if mode := values.Get("quantize"); stringExists(mode, QuantizeModes) {
+		q.Mode = mode
+	}
+
+	if colors, err := strconv.Atoi(values.Get("colors")); err == nil && colors >= 2 && colors <= QUANTIZE_COLORS {
+		q.Colors = colors
+	}
+
+	if dither, err := strconv.ParseBool(values.Get("dither")); err == nil {
+		q.Dither = dither
+	}
+
+	return q
+}
+
+// quantize reduces PNG to palette, the original is kept
+// if quantized image is not smaller
+func quantize(buf []byte, q QuantizeOptions) []byte {
+	var out []byte
+
+	switch q.Mode {
+	case "on":
+		if q.Colors == QUANTIZE_COLORS && q.Dither {
+			out = append([]byte(nil), buf...)
+			goquant.Quantize(&out)
+		} else {
+			out = quantizeImage(buf, q)
+		}
+	case "auto":
+		out = quantizeExact(buf, q.Colors)
+	}
+
+	if out == nil {
+		debug("PNG is not quantized, size: %d", len(buf))
+		return buf
+	}
+
+	debug("PNG quantized, size: %d -> %d", len(buf), len(out))
+	if len(out) >= len(buf) {
+		debug("Quantized PNG is not smaller, keeping the original")
+		return buf
+	}
+
+	return out
+}
+
+// quantizeImage reduces image to median cut palette
+func quantizeImage(buf []byte, q QuantizeOptions) []byte {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		warning("Can't decode PNG, reason - %s", err)
+		return nil
+	}
+
+	var palette color.Palette
+	for _, box := range medianCut(samplePixels(img, QUANTIZE_SAMPLES, true), q.Colors) {
+		palette = append(palette, box.average())
+	}
+
+	dst := image.NewPaletted(img.Bounds(), palette)
+	if q.Dither {
+		draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, img.Bounds().Min)
+	} else {
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+
+	return encodePaletted(dst)
+}
+
+// quantizeExact reduces image to palette only if it has
+// at most colors colours, so quality is not lost
+func quantizeExact(buf []byte, colors int) []byte {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		warning("Can't decode PNG, reason - %s", err)
+		return nil
+	}
+
+	if _, ok := img.(*image.Paletted); ok {
+		return nil
+	}
+
+	var palette color.Palette
+	seen := map[color.NRGBA]bool{}
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if seen[c] {
+				continue
+			}
+
+			if len(palette) == colors {
+				debug("PNG has more than %d colours", colors)
+				return nil
+			}
+			seen[c] = true
+			palette = append(palette, c)
+		}
+	}
+
+	dst := image.NewPaletted(bounds, palette)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	return encodePaletted(dst)
+}
+
+func encodePaletted(img *image.Paletted) []byte {
+	var out bytes.Buffer
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&out, img); err != nil {
+		warning("Can't encode PNG, reason - %s", err)
+		return nil
+	}
+
+	return out.Bytes()
+}
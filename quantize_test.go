@@ -0,0 +1,63 @@
+package imgwizard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+func TestParseQuantizeOptions(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Result QuantizeOptions
+	}{
+		{"", QuantizeOptions{QuantizeMode, 256, true}},
+		{"quantize=auto&colors=16", QuantizeOptions{"auto", 16, true}},
+		{"quantize=off&dither=false", QuantizeOptions{"off", 256, false}},
+		{"quantize=max&colors=1", QuantizeOptions{QuantizeMode, 256, true}},
+		{"colors=300&dither=x", QuantizeOptions{QuantizeMode, 256, true}},
+	}
+
+	for i, test := range tests {
+		values, _ := url.ParseQuery(test.Query)
+		if result := parseQuantizeOptions(values); result != test.Result {
+			t.Errorf("%d. parseQuantizeOptions returned %+v, needed %+v", i, result, test.Result)
+		}
+	}
+}
+
+func TestQuantizeAuto(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, image.Rect(0, 0, 32, 64), image.NewUniform(color.NRGBA{200, 30, 30, 255}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(32, 0, 64, 64), image.NewUniform(color.NRGBA{0, 0, 0, 0}), image.ZP, draw.Src)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	out := quantize(buf.Bytes(), QuantizeOptions{"auto", 2, true})
+	quantized, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("quantize returned invalid PNG: %s", err)
+	}
+
+	paletted, ok := quantized.(*image.Paletted)
+	if !ok {
+		t.Fatalf("quantize returned %T, needed *image.Paletted", quantized)
+	}
+
+	if _, _, _, a := paletted.At(40, 10).RGBA(); a != 0 {
+		t.Errorf("quantize lost transparency, alpha is %d", a)
+	}
+
+	if out := quantize(buf.Bytes(), QuantizeOptions{"auto", 1, true}); !bytes.Equal(out, buf.Bytes()) {
+		t.Errorf("quantize changed image with more colours than allowed")
+	}
+
+	if out := quantize(buf.Bytes(), QuantizeOptions{"off", 256, true}); !bytes.Equal(out, buf.Bytes()) {
+		t.Errorf("quantize changed image when off")
+	}
+}
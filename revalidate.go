@@ -0,0 +1,92 @@
+package imgwizard
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// CacheTTL is lifetime of processed image, expired one is revalidated
+// against its original, zero means processed images never expire
+var CacheTTL time.Duration
+
+// cacheValidators are original validators stored next to processed image
+type cacheValidators struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+	Version      string    `json:"version,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+// revalidate checks original of expired processed image with conditional
+// fetch, changed original is returned, nil means cached image may be served
+func revalidate(ctx *Context) ([]byte, error) {
+	if CacheTTL == 0 {
+		return nil, nil
+	}
+
+	data, err := Cache.Get(ctx.CachePath + VALIDATORS_CACHE_SUFFIX)
+	if err != nil {
+		return nil, nil
+	}
+
+	var validators cacheValidators
+	if err = json.Unmarshal(data, &validators); err != nil || time.Now().Before(validators.Expires) {
+		return nil, nil
+	}
+
+	debug("Revalidating original of expired image: %s", ctx.OrigImage)
+	ctx.OrigMeta = &OriginMeta{
+		ETag:         validators.ETag,
+		LastModified: validators.LastModified,
+		Version:      validators.Version,
+		Size:         validators.Size,
+	}
+
+	image, err := getOriginal(ctx)
+	if e, ok := err.(*ClassifiedError); ok && e.Kind == ErrOriginNotModified {
+		debug("Original is not modified, extending image lifetime")
+		setValidators(ctx, true)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Expired = true
+	return image, nil
+}
+
+// setValidators stores validators of fetched original next to processed image,
+// without them expired image is revalidated with unconditional fetch
+func setValidators(ctx *Context, replace bool) {
+	if CacheTTL == 0 {
+		return
+	}
+
+	meta := ctx.OrigMeta
+	if meta == nil {
+		meta = &OriginMeta{}
+	}
+
+	data, _ := json.Marshal(cacheValidators{
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Version:      meta.Version,
+		Size:         meta.Size,
+		Expires:      time.Now().Add(CacheTTL),
+	})
+
+	if err := cacheSet(ctx.CachePath+VALIDATORS_CACHE_SUFFIX, data, replace); err != nil {
+		warning("Can't set validators cache, reason - %s", err)
+	}
+}
+
+// cacheSet stores value, existing one is kept unless it must be replaced
+func cacheSet(key string, value []byte, replace bool) error {
+	if replace {
+		return Cache.Replace(key, value)
+	}
+
+	return Cache.Set(key, value)
+}
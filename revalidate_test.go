@@ -0,0 +1,128 @@
+package imgwizard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shifr/imgwizard/cache"
+)
+
+func TestRemoteConditionalFetch(t *testing.T) {
+	modified := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/etag.jpg" {
+			rw.Header().Set("ETag", `"v1"`)
+		}
+		http.ServeContent(rw, req, "image.jpg", modified, bytes.NewReader([]byte("image")))
+	}))
+	defer server.Close()
+
+	origin := remoteOrigin{client: newHTTPClient(time.Second, func(string, net.IP) bool { return true })}
+
+	tests := []struct {
+		Path     string
+		Cached   *OriginMeta
+		Modified bool
+	}{
+		{"/etag.jpg", nil, true},
+		{"/etag.jpg", &OriginMeta{ETag: `"v1"`}, false},
+		{"/etag.jpg", &OriginMeta{ETag: `"v0"`}, true},
+		{"/date.jpg", &OriginMeta{LastModified: modified}, false},
+		{"/date.jpg", &OriginMeta{LastModified: modified.Add(-time.Hour)}, true},
+	}
+
+	for i, test := range tests {
+		rc, meta, err := origin.Fetch(&Context{OrigMeta: test.Cached}, server.URL+test.Path)
+		if !test.Modified {
+			if e, ok := err.(*ClassifiedError); !ok || e.Kind != ErrOriginNotModified {
+				t.Errorf("%d. Fetch returned %v, needed not modified error", i, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d. Fetch returned %v", i, err)
+			continue
+		}
+		rc.Close()
+
+		if !meta.LastModified.Equal(modified) {
+			t.Errorf("%d. Fetch returned last modified %v, needed %v", i, meta.LastModified, modified)
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	root, err := ioutil.TempDir("", "imgwizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	original := filepath.Join(root, "image.jpg")
+	ioutil.WriteFile(original, []byte("image"), 0644)
+
+	storage := Cache
+	GlobalSettings.Directories = []string{root}
+	Cache = &cache.Cache{}
+	CacheTTL = time.Hour
+	defer func() {
+		GlobalSettings.Directories = nil
+		Cache = storage
+		CacheTTL = 0
+	}()
+
+	ctx := &Context{Storage: "loc", OrigImage: "image.jpg", CachePath: filepath.Join(root, "cache", "image_10x10.jpg")}
+	if _, err := getOriginal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	setValidators(ctx, false)
+
+	expire := func() {
+		var validators cacheValidators
+		data, _ := Cache.Get(ctx.CachePath + VALIDATORS_CACHE_SUFFIX)
+		json.Unmarshal(data, &validators)
+		validators.Expires = time.Now().Add(-time.Minute)
+		data, _ = json.Marshal(validators)
+		Cache.Replace(ctx.CachePath+VALIDATORS_CACHE_SUFFIX, data)
+	}
+
+	if image, err := revalidate(&Context{Storage: "loc", OrigImage: "image.jpg", CachePath: ctx.CachePath}); image != nil || err != nil {
+		t.Errorf("revalidate of fresh image returned %q, %v", image, err)
+	}
+
+	expire()
+	if image, err := revalidate(&Context{Storage: "loc", OrigImage: "image.jpg", CachePath: ctx.CachePath}); image != nil || err != nil {
+		t.Errorf("revalidate of not modified original returned %q, %v", image, err)
+	}
+
+	var validators cacheValidators
+	data, _ := Cache.Get(ctx.CachePath + VALIDATORS_CACHE_SUFFIX)
+	if json.Unmarshal(data, &validators); !validators.Expires.After(time.Now()) {
+		t.Errorf("revalidate didn't extend image lifetime, expires %v", validators.Expires)
+	}
+
+	expire()
+	ioutil.WriteFile(original, []byte("changed"), 0644)
+	changed := &Context{Storage: "loc", OrigImage: "image.jpg", CachePath: ctx.CachePath}
+	if image, err := revalidate(changed); string(image) != "changed" || err != nil || !changed.Expired {
+		t.Errorf("revalidate of modified original returned %q, %v, expired %v", image, err, changed.Expired)
+	}
+
+	// image got from other node has no validators of its original
+	node := &Context{Storage: "loc", OrigImage: "image.jpg", CachePath: filepath.Join(root, "cache", "node_10x10.jpg")}
+	setValidators(node, false)
+	ctx.CachePath = node.CachePath
+	expire()
+	if image, err := revalidate(node); string(image) != "changed" || err != nil {
+		t.Errorf("revalidate of image from node returned %q, %v", image, err)
+	}
+}
@@ -0,0 +1,165 @@
+package imgwizard
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/shifr/vips"
+)
+
+var Masks = []string{"circle"}
+
+// ShapeOptions are rounded corners, circle mask and border
+// applied to resized image
+type ShapeOptions struct {
+	Radius      int
+	Circle      bool
+	Border      int
+	BorderColor color.NRGBA
+}
+
+// parseShapeOptions parses "radius", "mask" and "border" params,
+// invalid values are ignored
+func parseShapeOptions(values url.Values) ShapeOptions {
+	var s ShapeOptions
+
+	if radius, err := strconv.Atoi(values.Get("radius")); err == nil && radius > 0 {
+		s.Radius = radius
+	}
+
+	s.Circle = values.Get("mask") == "circle"
+
+	if border := values.Get("border"); border != "" {
+		var err error
+		if s.Border, s.BorderColor, err = parseBorder(border); err != nil {
+			debug("Ignoring border, reason - %s", err)
+		}
+	}
+
+	return s
+}
+
+// parseBorder parses "width[,RRGGBB]" border, default colour is black
+func parseBorder(s string) (int, color.NRGBA, error) {
+	c := color.NRGBA{0, 0, 0, 255}
+	parts := strings.Split(s, ",")
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 || len(parts) > 2 {
+		return 0, c, fmt.Errorf("Invalid border %q, width[,RRGGBB] expected", s)
+	}
+
+	if len(parts) == 2 {
+		if c, err = parseColor(parts[1]); err != nil {
+			return 0, c, err
+		}
+	}
+
+	return width, c, nil
+}
+
+// Empty reports whether no shape operation is set
+func (s ShapeOptions) Empty() bool {
+	return s.Radius == 0 && !s.Circle && s.Border == 0
+}
+
+// transparent reports whether shape cuts out image corners
+func (s ShapeOptions) transparent() bool {
+	return s.Radius > 0 || s.Circle
+}
+
+// resizeWithShape resizes image to lossless PNG,
+// applies shape and encodes it to oType
+func resizeWithShape(buf []byte, oType string, ctx *Context, options vips.Options, steps resizeSteps) ([]byte, error) {
+	quality := options.Quality
+
+	out, err := vipsResize(buf, "png", options, steps, EncoderOptions{Compression: 1})
+	if err != nil {
+		return out, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		return out, err
+	}
+
+	debug("Applying shape %+v", ctx.Shape)
+	img = shape(img, ctx.Shape)
+
+	if oType != WEBP_HEADER && !ctx.Encoder.appliesTo(oType) {
+		return encodeImage(img, formatName(oType), quality)
+	}
+
+	var lossless bytes.Buffer
+	if err = png.Encode(&lossless, img); err != nil {
+		return nil, err
+	}
+
+	format := formatName(oType)
+	if oType == WEBP_HEADER {
+		format = "webp"
+	}
+
+	return vipsSave(lossless.Bytes(), format, quality, ctx.Encoder)
+}
+
+// shape applies rounded corners or circle mask and border to the image,
+// edges are antialiased
+func shape(img image.Image, s ShapeOptions) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	hx, hy, radius := w/2, h/2, math.Min(float64(s.Radius), math.Min(w, h)/2)
+	if s.Circle {
+		hx = math.Min(w, h) / 2
+		hy, radius = hx, hx
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			d := roundedRectDistance(
+				float64(x-bounds.Min.X)+0.5-w/2, float64(y-bounds.Min.Y)+0.5-h/2,
+				hx, hy, radius)
+
+			if s.Border > 0 {
+				c = mixColor(c, s.BorderColor, clamp(d+float64(s.Border)+0.5))
+			}
+			c.A = uint8(float64(c.A)*clamp(0.5-d) + 0.5)
+
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+
+	return dst
+}
+
+// roundedRectDistance returns signed distance from point to the edge
+// of rounded rectangle centred at zero, it's negative inside
+func roundedRectDistance(x, y, hx, hy, radius float64) float64 {
+	px := math.Abs(x) - hx + radius
+	py := math.Abs(y) - hy + radius
+
+	return math.Hypot(math.Max(px, 0), math.Max(py, 0)) +
+		math.Min(math.Max(px, py), 0) - radius
+}
+
+func mixColor(a, b color.NRGBA, t float64) color.NRGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x)*(1-t) + float64(y)*t + 0.5)
+	}
+
+	return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,76 @@
+package imgwizard
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"testing"
+)
+
+func TestParseShapeOptions(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Result ShapeOptions
+	}{
+		{"", ShapeOptions{}},
+		{"radius=10&mask=circle", ShapeOptions{Radius: 10, Circle: true}},
+		{"border=2", ShapeOptions{Border: 2, BorderColor: color.NRGBA{0, 0, 0, 255}}},
+		{"border=3,ff0000", ShapeOptions{Border: 3, BorderColor: color.NRGBA{255, 0, 0, 255}}},
+		{"radius=-1&mask=star&border=2,red", ShapeOptions{}},
+	}
+
+	for i, test := range tests {
+		values, _ := url.ParseQuery(test.Query)
+		if result := parseShapeOptions(values); result != test.Result {
+			t.Errorf("%d. parseShapeOptions returned %+v, needed %+v", i, result, test.Result)
+		}
+	}
+}
+
+func TestShape(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	red := color.NRGBA{255, 0, 0, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Bounds(), image.NewUniform(white), image.ZP, draw.Src)
+
+	tests := []struct {
+		Shape  ShapeOptions
+		X, Y   int
+		Result color.NRGBA
+	}{
+		{ShapeOptions{Radius: 8}, 0, 0, color.NRGBA{255, 255, 255, 0}},
+		{ShapeOptions{Radius: 8}, 20, 0, white},
+		{ShapeOptions{Radius: 8}, 39, 10, white},
+		{ShapeOptions{Circle: true}, 5, 10, color.NRGBA{255, 255, 255, 0}},
+		{ShapeOptions{Circle: true}, 20, 10, white},
+		{ShapeOptions{Border: 2, BorderColor: red}, 0, 0, red},
+		{ShapeOptions{Border: 2, BorderColor: red}, 38, 18, red},
+		{ShapeOptions{Border: 2, BorderColor: red}, 2, 2, white},
+		{ShapeOptions{Circle: true, Border: 2, BorderColor: red}, 20, 1, red},
+		{ShapeOptions{Circle: true, Border: 2, BorderColor: red}, 20, 10, white},
+	}
+
+	for i, test := range tests {
+		if c := shape(img, test.Shape).(*image.NRGBA).NRGBAAt(test.X, test.Y); c != test.Result {
+			t.Errorf("%d. shape colour at %d,%d is %v, needed %v", i, test.X, test.Y, c, test.Result)
+		}
+	}
+}
+
+func TestShapeOutputType(t *testing.T) {
+	ctx := &Context{Shape: ShapeOptions{Radius: 4}}
+	if oType := outputType(JPEG, ctx); oType != PNG {
+		t.Errorf("outputType returned %v for rounded JPEG, needed %v", oType, PNG)
+	}
+
+	ctx.Options.Webp = true
+	if oType := outputType(JPEG, ctx); oType != WEBP_HEADER {
+		t.Errorf("outputType returned %v for rounded WebP, needed %v", oType, WEBP_HEADER)
+	}
+
+	ctx = &Context{Shape: ShapeOptions{Border: 1}, Format: "jpeg"}
+	if oType := outputType(PNG, ctx); oType != JPEG {
+		t.Errorf("outputType returned %v for bordered JPEG, needed %v", oType, JPEG)
+	}
+}
@@ -0,0 +1,73 @@
+package imgwizard
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// SIGNATURE_EXP matches URL-safe base64 of HMAC-SHA256 without padding
+const SIGNATURE_EXP = "[A-Za-z0-9_-]{43}"
+
+// Sign returns URL-safe base64 HMAC-SHA256 of the path
+func Sign(key, path string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL returns signed URL path, path is everything after the mark
+// including query, e.g. "rem/320x240/media.com/image.jpg?q=90", it's
+// signed as is, so it must be escaped the way it's requested
+func SignedURL(key, mark, path string) string {
+	path = strings.TrimPrefix(path, "/")
+
+	return fmt.Sprintf("/%s/%s/%s", mark, Sign(key, path), path)
+}
+
+// verifySignature checks signature against every active key,
+// so keys can be rotated without breaking already issued URLs
+func verifySignature(signature, path string) bool {
+	for _, key := range GlobalSettings.SignKeys {
+		if hmac.Equal([]byte(signature), []byte(Sign(key, path))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkSignature verifies request signature if signing is enabled,
+// exp is the route regexp with "signature" and "signed" groups,
+// escaped path is verified as SignedURL signs it
+func checkSignature(req *http.Request, exp *regexp.Regexp) bool {
+	if len(GlobalSettings.SignKeys) == 0 {
+		return true
+	}
+
+	match := exp.FindStringSubmatch(req.URL.EscapedPath())
+	if match == nil {
+		return false
+	}
+
+	var signature, signed string
+	for i, name := range exp.SubexpNames() {
+		switch name {
+		case "signature":
+			signature = match[i]
+		case "signed":
+			signed = match[i]
+		}
+	}
+
+	if req.URL.RawQuery != "" {
+		signed = fmt.Sprintf("%s?%s", signed, req.URL.RawQuery)
+	}
+
+	return verifySignature(signature, signed)
+}
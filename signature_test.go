@@ -0,0 +1,82 @@
+package imgwizard
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheckSignature(t *testing.T) {
+	keys := GlobalSettings.SignKeys
+	GlobalSettings.SignKeys = []string{"new", "old"}
+	defer func() { GlobalSettings.SignKeys = keys }()
+
+	exp := regexp.MustCompile(fmt.Sprintf(
+		"/(?P<mark>images)/(?:(?P<signature>%s)/)?(?P<signed>(?P<storage>rem)/(?P<size>320x240)/(?P<path>.+))",
+		SIGNATURE_EXP))
+
+	path := "rem/320x240/media.somesite.ua/uploads/image.jpg?crop=top&q=90"
+	escaped := "rem/320x240/media.somesite.ua/uploads/a%20b+c%D1%84%2B.jpg?q=90"
+
+	tests := []struct {
+		URL   string
+		Valid bool
+	}{
+		{SignedURL("new", "images", path), true},
+		{SignedURL("old", "images", path), true},
+		{SignedURL("other", "images", path), false},
+		{SignedURL("new", "images", path) + "&q=10", false},
+		{"/images/" + path, false},
+		{SignedURL("new", "images", escaped), true},
+		{SignedURL("new", "images", "rem/320x240/media.somesite.ua/uploads/a b+cф+.jpg?q=90"), false},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+test.URL, nil)
+
+		if valid := checkSignature(req, exp); valid != test.Valid {
+			t.Errorf("%d. checkSignature(%s) returned %v, needed %v", i, test.URL, valid, test.Valid)
+		}
+	}
+}
+
+func TestSignedPath(t *testing.T) {
+	keys := GlobalSettings.SignKeys
+	GlobalSettings.SignKeys = []string{"new"}
+	defer func() { GlobalSettings.SignKeys = keys }()
+
+	Mark = "images"
+	exp := urlExp("[0-9]*x[0-9]*")
+	signed := SignedURL("new", "images", "rem/320x240/media.com/a%2Bb.jpg")
+
+	tests := []struct {
+		URL   string
+		Valid bool
+		Size  string
+		Path  string
+	}{
+		{signed, true, "320x240", "media.com/a+b.jpg"},
+		{"/%69mages/" + strings.Repeat("a", 43) + "/rem/9999x9999/evil.host/x" + signed, false, "", ""},
+		{"/images/" + strings.Repeat("a", 43) + "/rem/9999x9999/evil.host/x" + signed, false, "", ""},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+test.URL, nil)
+
+		if valid := checkSignature(req, exp); valid != test.Valid {
+			t.Errorf("%d. checkSignature(%s) returned %v, needed %v", i, test.URL, valid, test.Valid)
+			continue
+		}
+		if !test.Valid {
+			continue
+		}
+
+		params := parseVars(req, exp)
+		if params["size"] != test.Size || params["path"] != test.Path {
+			t.Errorf("%d. parseVars(%s) returned %v, %v, needed %v, %v",
+				i, test.URL, params["size"], params["path"], test.Size, test.Path)
+		}
+	}
+}
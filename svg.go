@@ -0,0 +1,232 @@
+package imgwizard
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	SVG_DEFAULT_DENSITY = 72
+	SVG_MAX_DENSITY     = 600
+	SVG_MAX_PIXELS      = 25000000
+	SVG_SNIFF_SIZE      = 4096
+)
+
+var (
+	SVGSafe     = true
+	SVGMaxBytes = 1 << 20
+
+	// svgUnits are lengths of units in pixels at 72 dpi
+	svgUnits = map[string]float64{
+		"":   1,
+		"px": 1,
+		"pt": 1,
+		"pc": 12,
+		"in": 72,
+		"cm": 72 / 2.54,
+		"mm": 72 / 25.4,
+	}
+
+	ErrSVGTooBig = errors.New("SVG is too big")
+)
+
+// isSVG reports whether buffer is SVG image
+func isSVG(buf []byte) bool {
+	if !strings.HasPrefix(http.DetectContentType(buf), "text/") {
+		return false
+	}
+
+	head := buf
+	if len(head) > SVG_SNIFF_SIZE {
+		head = head[:SVG_SNIFF_SIZE]
+	}
+
+	return bytes.Contains(head, []byte("<svg"))
+}
+
+// rasterizeSVG renders SVG to PNG large enough for the requested size
+// and not less than requested density
+func rasterizeSVG(buf []byte, ctx *Context) ([]byte, error) {
+	if SVGSafe && len(buf) > SVGMaxBytes {
+		return nil, ErrSVGTooBig
+	}
+
+	width, height, err := parseSVG(buf, SVGSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	density := ctx.Density
+	if density == 0 {
+		density = SVG_DEFAULT_DENSITY
+	}
+
+	scale := float64(density) / SVG_DEFAULT_DENSITY
+	if width > 0 && height > 0 {
+		if s := float64(ctx.Options.Width) / width; s > scale {
+			scale = s
+		}
+		if s := float64(ctx.Options.Height) / height; s > scale {
+			scale = s
+		}
+
+		if width*height*scale*scale > SVG_MAX_PIXELS {
+			scale = math.Sqrt(SVG_MAX_PIXELS / (width * height))
+		}
+	}
+
+	debug("Rasterizing SVG %gx%g with scale %g", width, height, scale)
+	return vipsRasterize(buf, scale)
+}
+
+// parseSVG returns SVG size in pixels at 72 dpi, zero if it's not set,
+// in safe mode SVG with external references or entities is refused
+func parseSVG(buf []byte, safe bool) (float64, float64, error) {
+	var width, height float64
+
+	decoder := xml.NewDecoder(bytes.NewReader(buf))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	for root := true; ; {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return width, height, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Can't parse SVG, reason - %s", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if root && t.Name.Local == "svg" {
+				width, height = svgSize(t.Attr)
+				root = false
+			}
+
+			if !safe {
+				if root {
+					continue
+				}
+				return width, height, nil
+			}
+
+			if err = checkSVGElement(t); err != nil {
+				return 0, 0, err
+			}
+		case xml.CharData:
+			if safe && externalURL(string(t)) {
+				return 0, 0, errors.New("SVG has external reference in style")
+			}
+		case xml.Directive:
+			if safe && bytes.Contains(t, []byte("ENTITY")) {
+				return 0, 0, errors.New("SVG has entity declaration")
+			}
+		case xml.ProcInst:
+			if safe && t.Target == "xml-stylesheet" {
+				return 0, 0, errors.New("SVG has external stylesheet")
+			}
+		}
+	}
+}
+
+// checkSVGElement refuses scripts, foreign objects and external references
+func checkSVGElement(t xml.StartElement) error {
+	switch t.Name.Local {
+	case "script", "foreignObject":
+		return fmt.Errorf("SVG has %s element", t.Name.Local)
+	}
+
+	for _, attr := range t.Attr {
+		value := strings.TrimSpace(attr.Value)
+
+		if attr.Name.Local == "href" && !strings.HasPrefix(value, "#") && !strings.HasPrefix(value, "data:") {
+			return fmt.Errorf("SVG has external reference %q", value)
+		}
+
+		if externalURL(value) {
+			return fmt.Errorf("SVG has external reference in %s", attr.Name.Local)
+		}
+	}
+
+	return nil
+}
+
+// externalURL reports whether CSS value has url() or @import
+// pointing not to the same document
+func externalURL(s string) bool {
+	if strings.Contains(s, "@import") {
+		return true
+	}
+
+	for _, part := range strings.Split(s, "url(")[1:] {
+		target := strings.TrimLeft(part, " \t\n\"'")
+		if !strings.HasPrefix(target, "#") && !strings.HasPrefix(target, "data:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// svgSize returns size from width and height attributes,
+// viewBox is used for missing or relative ones
+func svgSize(attrs []xml.Attr) (float64, float64) {
+	var width, height, boxWidth, boxHeight float64
+
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "width":
+			width = svgLength(attr.Value)
+		case "height":
+			height = svgLength(attr.Value)
+		case "viewBox":
+			box := strings.FieldsFunc(attr.Value, func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+			if len(box) == 4 {
+				boxWidth, _ = strconv.ParseFloat(box[2], 64)
+				boxHeight, _ = strconv.ParseFloat(box[3], 64)
+			}
+		}
+	}
+
+	switch {
+	case width > 0 && height > 0:
+		return width, height
+	case width > 0 && boxWidth > 0:
+		return width, width * boxHeight / boxWidth
+	case height > 0 && boxHeight > 0:
+		return height * boxWidth / boxHeight, height
+	}
+
+	return boxWidth, boxHeight
+}
+
+// svgLength converts SVG length to pixels, 0 is returned
+// for relative or invalid lengths
+func svgLength(s string) float64 {
+	s = strings.TrimSpace(s)
+	number := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz%")
+
+	unit, ok := svgUnits[s[len(number):]]
+	if !ok {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+
+	return value * unit
+}
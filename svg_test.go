@@ -0,0 +1,43 @@
+package imgwizard
+
+import "testing"
+
+func TestParseSVG(t *testing.T) {
+	tests := []struct {
+		SVG    string
+		Width  float64
+		Height float64
+		Valid  bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg" width="120" height="40"><rect width="10" height="10"/></svg>`, 120, 40, true},
+		{`<?xml version="1.0"?><svg viewBox="0 0 300 150" width="1in"><path d="M0 0"/></svg>`, 72, 36, true},
+		{`<svg viewBox="0,0,30,20" width="100%"><use href="#logo"/></svg>`, 30, 20, true},
+		{`<svg width="10" height="10"><image href="data:image/png;base64,AAAA"/><rect fill="url(#grad)"/></svg>`, 10, 10, true},
+		{`<svg width="10" height="10"><image href="http://example.com/a.png"/></svg>`, 0, 0, false},
+		{`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="file:///etc/passwd"/></svg>`, 0, 0, false},
+		{`<svg><rect style="fill: url( 'https://example.com/p.svg#p')"/></svg>`, 0, 0, false},
+		{`<svg><style>@import url(https://example.com/a.css);</style></svg>`, 0, 0, false},
+		{`<svg><script>alert(1)</script></svg>`, 0, 0, false},
+		{`<!DOCTYPE svg [<!ENTITY a "aaaa">]><svg>&a;</svg>`, 0, 0, false},
+		{`<?xml-stylesheet href="http://example.com/a.css"?><svg></svg>`, 0, 0, false},
+	}
+
+	for i, test := range tests {
+		if !isSVG([]byte(test.SVG)) {
+			t.Errorf("%d. isSVG returned false", i)
+		}
+
+		width, height, err := parseSVG([]byte(test.SVG), true)
+		if test.Valid && (err != nil || width != test.Width || height != test.Height) {
+			t.Errorf("%d. parseSVG returned %v, %v, %v, needed %v, %v", i, width, height, err, test.Width, test.Height)
+		}
+
+		if !test.Valid && err == nil {
+			t.Errorf("%d. parseSVG returned nil, needed error", i)
+		}
+	}
+
+	if isSVG([]byte("<html><body>svg</body></html>")) {
+		t.Errorf("isSVG returned true for HTML")
+	}
+}
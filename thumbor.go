@@ -0,0 +1,221 @@
+package imgwizard
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// thumborURL is a parsed thumbor URL
+type thumborURL struct {
+	Signature string
+	Signed    string
+	Storage   string
+	Scheme    string
+	Size      string
+	Image     string
+	Params    url.Values
+}
+
+var (
+	// thumborExp follows thumbor URL scheme:
+	// /{unsafe|signature}/trim/AxB:CxD/fit-in/WxH/halign/valign/smart/filters:.../image
+	thumborExp = regexp.MustCompile(
+		"^/(?P<signature>unsafe|[A-Za-z0-9_=-]{28})/(?P<signed>" +
+			"(?:(?P<trim>trim(?::(?:top-left|bottom-right))?(?::[0-9]+)?)/)?" +
+			"(?:(?P<crop>[0-9]+x[0-9]+:[0-9]+x[0-9]+)/)?" +
+			"(?:(?P<fitin>(?:adaptive-)?(?:full-)?fit-in)/)?" +
+			"(?:-?(?P<width>[0-9]+|orig)?x-?(?P<height>[0-9]+|orig)?/)?" +
+			"(?:(?P<halign>left|right|center)/)?" +
+			"(?:(?P<valign>top|bottom|middle)/)?" +
+			"(?:(?P<smart>smart)/)?" +
+			"(?:filters:(?P<filters>.+?\\))/)?" +
+			"(?P<image>.+))$")
+	thumborFilterExp = regexp.MustCompile("([a-z_]+)\\(([^)]*)\\)")
+
+	ThumborFormats = map[string]string{
+		"jpeg": "jpeg",
+		"jpg":  "jpeg",
+		"png":  "png",
+		"webp": "webp",
+	}
+
+	ErrThumborURL       = errors.New("Not a thumbor URL")
+	ErrThumborSignature = errors.New("Invalid thumbor signature")
+	ErrThumborForbidden = errors.New("Media or size is not allowed")
+)
+
+// parseThumbor parses thumbor URL path into imgwizard options
+func parseThumbor(path string) (*thumborURL, error) {
+	match := thumborExp.FindStringSubmatch(path)
+	if match == nil {
+		return nil, ErrThumborURL
+	}
+
+	params := map[string]string{}
+	for i, name := range thumborExp.SubexpNames() {
+		params[name] = match[i]
+	}
+
+	t := &thumborURL{
+		Signature: params["signature"],
+		Signed:    params["signed"],
+		Storage:   ThumborStorage,
+		Params:    url.Values{},
+	}
+
+	if params["crop"] != "" {
+		var left, top, right, bottom int
+		fmt.Sscanf(params["crop"], "%dx%d:%dx%d", &left, &top, &right, &bottom)
+		t.Params.Set("rect", fmt.Sprintf("%d,%d,%d,%d",
+			left, top, right-left, bottom-top))
+	}
+
+	if params["fitin"] != "" {
+		t.Params.Set("mode", "fit")
+	}
+
+	width := strings.TrimPrefix(params["width"], "orig")
+	height := strings.TrimPrefix(params["height"], "orig")
+	t.Size = fmt.Sprintf("%sx%s", width, height)
+
+	var gravity []string
+	if params["halign"] == "left" || params["halign"] == "right" {
+		gravity = append(gravity, params["halign"])
+	}
+	if params["valign"] == "top" || params["valign"] == "bottom" {
+		gravity = append(gravity, params["valign"])
+	}
+	if len(gravity) > 0 {
+		t.Params.Set("crop", strings.Join(gravity, ","))
+	}
+
+	if params["trim"] != "" {
+		t.Params.Set("trim", strings.TrimPrefix(
+			strings.TrimPrefix(params["trim"], "trim"), ":"))
+	}
+
+	for _, filter := range thumborFilterExp.FindAllStringSubmatch(params["filters"], -1) {
+		name, arg := filter[1], filter[2]
+
+		switch name {
+		case "quality":
+			if _, err := strconv.Atoi(arg); err == nil {
+				t.Params.Set("q", arg)
+			}
+		case "format":
+			if format, ok := ThumborFormats[arg]; ok {
+				t.Params.Set("format", format)
+			}
+		case "fill", "background_color":
+			if _, err := parseColor(arg); err != nil {
+				debug("Thumbor %s colour %q is not supported, ignoring", name, arg)
+				break
+			}
+
+			t.Params.Set("bg", arg)
+			if name == "fill" && t.Params.Get("mode") == "fit" {
+				t.Params.Set("mode", "pad")
+			}
+		default:
+			debug("Thumbor filter %s is not supported, ignoring", name)
+		}
+	}
+
+	t.Image = params["image"]
+	for _, scheme := range []string{"http", "https"} {
+		if strings.HasPrefix(t.Image, scheme+"://") {
+			t.Image = strings.TrimPrefix(t.Image, scheme+"://")
+			t.Scheme = scheme
+			t.Storage = "rem"
+		}
+	}
+
+	return t, nil
+}
+
+// verify checks thumbor HMAC-SHA1 signature,
+// unsafe URLs are allowed only if signing is disabled
+func (t *thumborURL) verify() bool {
+	if t.Signature == "unsafe" {
+		return len(GlobalSettings.SignKeys) == 0
+	}
+
+	for _, key := range GlobalSettings.SignKeys {
+		mac := hmac.New(sha1.New, []byte(key))
+		mac.Write([]byte(t.Signed))
+		expected := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+		if hmac.Equal([]byte(t.Signature), []byte(expected)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowed applies "-m", "-s" and "-presets-only" restrictions,
+// sizes are a part of URL regexp for imgwizard URLs
+func (t *thumborURL) allowed() bool {
+	if PresetsOnly {
+		return false
+	}
+
+	if len(GlobalSettings.AllowedSizes) > 0 && !stringExists(t.Size, GlobalSettings.AllowedSizes) {
+		return false
+	}
+
+	return GlobalSettings.Media.Allowed(t.Storage, t.Image)
+}
+
+// FillThumbor sets up context from thumbor URL
+func (c *Context) FillThumbor(req *http.Request) error {
+	t, err := parseThumbor(req.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	// thumbor clients sign quoted path while
+	// options are parsed from the unquoted one
+	t.Signed = strings.SplitN(req.URL.EscapedPath(), "/", 3)[2]
+
+	if !t.verify() {
+		return ErrThumborSignature
+	}
+
+	if !t.allowed() {
+		return ErrThumborForbidden
+	}
+
+	c.Scheme = t.Scheme
+	return c.fill(req, t.Storage, t.Size, t.Image, t.Params, t.Params.Encode())
+}
+
+// FetchThumborImage serves thumbor compatible URLs
+func FetchThumborImage(rw http.ResponseWriter, req *http.Request) {
+	context := Context{}
+
+	switch err := context.FillThumbor(req); err {
+	case nil:
+	case ErrThumborURL:
+		http.NotFound(rw, req)
+		return
+	case ErrThumborSignature, ErrThumborForbidden:
+		debug("Thumbor URL rejected: %s, reason - %s", req.RequestURI, err)
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	default:
+		debug("Invalid params: %s, reason - %s", req.RequestURI, err)
+		http.Error(rw, err.Error(), errorStatus(err))
+		return
+	}
+
+	serveImage(rw, req, &context)
+}
@@ -0,0 +1,104 @@
+package imgwizard
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestParseThumbor(t *testing.T) {
+	storage := ThumborStorage
+	ThumborStorage = "rem"
+	defer func() { ThumborStorage = storage }()
+
+	tests := []struct {
+		Path    string
+		Storage string
+		Scheme  string
+		Size    string
+		Image   string
+		Query   string
+	}{
+		{
+			"/unsafe/300x200/media.somesite.ua/uploads/image.jpg",
+			"rem", "", "300x200", "media.somesite.ua/uploads/image.jpg",
+			"",
+		},
+		{
+			"/unsafe/fit-in/300x/https://media.somesite.ua/uploads/image.jpg",
+			"rem", "https", "300x", "media.somesite.ua/uploads/image.jpg",
+			"mode=fit",
+		},
+		{
+			"/unsafe/10x20:110x220/-origx200/left/top/smart/media.somesite.ua/image.jpg",
+			"rem", "", "x200", "media.somesite.ua/image.jpg",
+			"crop=left%2Ctop&rect=10%2C20%2C100%2C200",
+		},
+		{
+			"/unsafe/320x240/filters:quality(90):format(jpg):blur(7)/media.somesite.ua/image.png",
+			"rem", "", "320x240", "media.somesite.ua/image.png",
+			"format=jpeg&q=90",
+		},
+		{
+			"/unsafe/fit-in/320x240/filters:fill(ff0000)/media.somesite.ua/image.png",
+			"rem", "", "320x240", "media.somesite.ua/image.png",
+			"bg=ff0000&mode=pad",
+		},
+	}
+
+	for i, test := range tests {
+		thumbor, err := parseThumbor(test.Path)
+		if err != nil {
+			t.Errorf("%d. parseThumbor returned error %v", i, err)
+			continue
+		}
+
+		if thumbor.Storage != test.Storage || thumbor.Scheme != test.Scheme ||
+			thumbor.Size != test.Size || thumbor.Image != test.Image ||
+			thumbor.Params.Encode() != test.Query {
+			t.Errorf("%d. parseThumbor returned %+v", i, thumbor)
+		}
+	}
+
+	if _, err := parseThumbor("/images/rem/300x200/media.somesite.ua/image.jpg"); err != ErrThumborURL {
+		t.Errorf("parseThumbor returned %v for imgwizard URL, needed %v", err, ErrThumborURL)
+	}
+}
+
+func TestThumborSignature(t *testing.T) {
+	keys := GlobalSettings.SignKeys
+	GlobalSettings.SignKeys = []string{"secret"}
+	defer func() { GlobalSettings.SignKeys = keys }()
+
+	sign := func(path string) string {
+		mac := hmac.New(sha1.New, []byte("secret"))
+		mac.Write([]byte(path))
+		return "/" + base64.URLEncoding.EncodeToString(mac.Sum(nil)) + "/" + path
+	}
+
+	encoded := "300x200/http%3A%2F%2Fmedia.somesite.ua%2Fa%20b.jpg"
+
+	tests := []struct {
+		URL   string
+		Image string
+		Err   error
+	}{
+		{sign(encoded), "media.somesite.ua/a b.jpg", nil},
+		{sign("300x200/media.somesite.ua/image.jpg"), "media.somesite.ua/image.jpg", nil},
+		{sign("300x200/http://media.somesite.ua/a b.jpg"), "", ErrThumborSignature},
+		{"/unsafe/" + encoded, "", ErrThumborSignature},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+test.URL, nil)
+		context := Context{}
+
+		if err := context.FillThumbor(req); err != test.Err {
+			t.Errorf("%d. FillThumbor(%s) returned %v, needed %v", i, test.URL, err, test.Err)
+		} else if err == nil && context.Path != test.Image {
+			t.Errorf("%d. FillThumbor(%s) returned path %v, needed %v", i, test.URL, context.Path, test.Image)
+		}
+	}
+}
@@ -1,31 +1,229 @@
 package imgwizard
 
 import (
+	"bytes"
+	"image"
+	"math"
 	"net/http"
+	"strconv"
 
-	"github.com/shifr/goquant"
 	"github.com/shifr/vips"
 )
 
-func Transform(img_buff *[]byte, ctx *Context) {
+// Transform processes image in place, error is returned
+// only for options that don't fit the image
+func Transform(img_buff *[]byte, ctx *Context) error {
 	var err error
 
+	var raster []byte
+	switch {
+	case isSVG(*img_buff):
+		raster, err = rasterizeSVG(*img_buff, ctx)
+	case http.DetectContentType(*img_buff) == PDF:
+		raster, err = rasterizePDF(*img_buff, ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+	if raster != nil {
+		*img_buff = raster
+	}
+
 	debug("Detecting image type...")
 	iType := http.DetectContentType(*img_buff)
 
 	if !stringExists(iType, ResizableImageTypes) {
 		warning("Wizard resize doesn't support image type, returning original image")
-		return
+		return nil
+	}
+
+	if ctx.needsArea() {
+		debug("Looking for crop area...")
+		if ctx.Area, err = cropArea(*img_buff, ctx); err != nil {
+			return err
+		}
+	}
+
+	if DominantColorHeader {
+		if img, err := areaThumbnail(*img_buff, ctx.Area, PALETTE_THUMB_SIZE); err == nil {
+			ctx.setHeader(DOMINANT_COLOR_HEADER, hexColor(dominantColor(img)))
+		} else {
+			warning("Can't get dominant colour, reason - %s", err)
+		}
+	}
+
+	if ctx.MaxBytes > 0 {
+		*img_buff, err = fitMaxBytes(*img_buff, iType, ctx)
+	} else {
+		*img_buff, err = resize(*img_buff, iType, ctx, ctx.Options)
 	}
 
-	*img_buff, err = vips.Resize(*img_buff, ctx.Options)
 	if err != nil {
 		warning("Can't resize img, reason - %s", err)
-		return
 	}
 
-	if iType == PNG && !ctx.Options.Webp {
-		goquant.Quantize(img_buff)
-		debug("NEW IMAGE SIZE: %d", len(*img_buff))
+	return nil
+}
+
+// resize resizes image and encodes it to the requested format
+func resize(buf []byte, iType string, ctx *Context, options vips.Options) ([]byte, error) {
+	oType := outputType(iType, ctx)
+	steps := ctx.resizeSteps(iType)
+
+	if !ctx.Shape.Empty() {
+		out, err := resizeWithShape(buf, oType, ctx, options, steps)
+		if err == nil && oType == PNG && !ctx.Encoder.appliesTo(oType) {
+			out = quantize(out, ctx.Quantize)
+		}
+		return out, err
+	}
+
+	if ctx.Encoder.appliesTo(oType) || !steps.Empty() {
+		out, err := resizeWithVips(buf, oType, ctx, options, steps)
+		if err == nil && oType == PNG && !ctx.Encoder.appliesTo(oType) {
+			out = quantize(out, ctx.Quantize)
+		}
+		return out, err
+	}
+
+	out, err := vips.Resize(buf, options)
+	if err != nil {
+		return out, err
+	}
+
+	if oType, ok := Encoders[ctx.Format]; ok && oType != iType && !options.Webp {
+		debug("Converting image to %s", ctx.Format)
+		if converted, err := convertImage(out, ctx.Format, options.Quality); err == nil {
+			out = converted
+			iType = oType
+		} else {
+			warning("Can't convert img, reason - %s", err)
+		}
+	}
+
+	if iType == PNG && !options.Webp {
+		out = quantize(out, ctx.Quantize)
+	}
+
+	return out, nil
+}
+
+// resizeWithVips resizes, flattens and pads image and encodes it
+// with encoder options to oType straight from vips
+func resizeWithVips(buf []byte, oType string, ctx *Context, options vips.Options, steps resizeSteps) ([]byte, error) {
+	format := formatName(oType)
+	if oType == WEBP_HEADER {
+		format = "webp"
+	}
+
+	debug("Resizing image to %s with %+v, %+v", format, steps, ctx.Encoder)
+	return vipsResize(buf, format, options, steps, ctx.Encoder)
+}
+
+// outputType returns type of resized image, JPEG is replaced
+// with PNG if shape makes image transparent
+func outputType(iType string, ctx *Context) string {
+	if ctx.Options.Webp {
+		return WEBP_HEADER
+	}
+
+	oType := iType
+	if t, ok := Encoders[ctx.Format]; ok {
+		oType = t
+	}
+
+	if oType == JPEG && ctx.Shape.transparent() {
+		return PNG
+	}
+
+	return oType
+}
+
+// fitMaxBytes looks for the highest quality giving image not bigger
+// than ctx.MaxBytes, image is made smaller if even minimal quality is too big
+func fitMaxBytes(buf []byte, iType string, ctx *Context) ([]byte, error) {
+	var best, fallback []byte
+
+	options := ctx.Options
+	lo, hi := MaxBytesMinQuality, options.Quality
+	if MaxBytesMaxQuality < hi {
+		hi = MaxBytesMaxQuality
+	}
+	if lo > hi {
+		lo = hi
+	}
+
+	if outputType(iType, ctx) != PNG {
+		minQuality := lo
+		for lo <= hi {
+			options.Quality = (lo + hi) / 2
+			out, err := resize(buf, iType, ctx, options)
+			if err != nil {
+				return out, err
+			}
+
+			debug("Quality %d gives %d bytes", options.Quality, len(out))
+			if options.Quality == minQuality {
+				fallback = out
+			}
+			if len(out) <= ctx.MaxBytes {
+				best = out
+				ctx.setHeader(QUALITY_HEADER, strconv.Itoa(options.Quality))
+				lo = options.Quality + 1
+			} else {
+				hi = options.Quality - 1
+			}
+		}
+
+		if best != nil {
+			return best, nil
+		}
+
+		options.Quality = minQuality
+		ctx.setHeader(QUALITY_HEADER, strconv.Itoa(minQuality))
+	}
+
+	if fallback == nil {
+		out, err := resize(buf, iType, ctx, options)
+		if err != nil {
+			return out, err
+		}
+		fallback = out
 	}
+
+	if options.Width == 0 && options.Height == 0 {
+		options.Width = ctx.Area.Dx()
+		if config, _, err := image.DecodeConfig(bytes.NewReader(buf)); err == nil && options.Width == 0 {
+			options.Width = config.Width
+		}
+	}
+
+	for i := 0; i < MAXBYTES_SHRINK_STEPS && len(fallback) > ctx.MaxBytes; i++ {
+		options.Width, options.Height = shrinkSize(options.Width, options.Height, len(fallback), ctx.MaxBytes)
+		if options.Width == 0 && options.Height == 0 {
+			break
+		}
+
+		out, err := resize(buf, iType, ctx, options)
+		if err != nil {
+			return out, err
+		}
+
+		fallback = out
+		debug("Size %dx%d gives %d bytes", options.Width, options.Height, len(out))
+	}
+
+	if len(fallback) > ctx.MaxBytes {
+		warning("Can't fit image into %d bytes", ctx.MaxBytes)
+	}
+
+	return fallback, nil
+}
+
+// shrinkSize returns smaller size for image of size bytes to fit into
+// maxBytes, image bytes are taken as proportional to pixels count
+func shrinkSize(width, height, size, maxBytes int) (int, int) {
+	scale := math.Sqrt(float64(maxBytes)/float64(size)) * MAXBYTES_SHRINK_MARGIN
+	return int(float64(width) * scale), int(float64(height) * scale)
 }
@@ -0,0 +1,25 @@
+package imgwizard
+
+import "testing"
+
+func TestShrinkSize(t *testing.T) {
+	tests := []struct {
+		Width    int
+		Height   int
+		Size     int
+		MaxBytes int
+		Result   [2]int
+	}{
+		{1000, 500, 400000, 100000, [2]int{450, 225}},
+		{1000, 0, 110000, 100000, [2]int{858, 0}},
+		{1000, 1000, 100001, 100000, [2]int{899, 899}},
+		{1, 0, 400000, 100000, [2]int{0, 0}},
+	}
+
+	for i, test := range tests {
+		width, height := shrinkSize(test.Width, test.Height, test.Size, test.MaxBytes)
+		if result := [2]int{width, height}; result != test.Result {
+			t.Errorf("%d. shrinkSize returned %v, needed %v", i, result, test.Result)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package imgwizard
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+static int imgw_pngsave(VipsImage *image, void **out, size_t *out_len) {
+	int err;
+
+	err = vips_pngsave_buffer(image, out, out_len, "compression", 1, NULL);
+	g_object_unref(image);
+
+	return err;
+}
+
+static int imgw_rasterize(void *in, size_t in_len, double scale,
+	void **out, size_t *out_len) {
+	VipsImage *image;
+
+	if (vips_svgload_buffer(in, in_len, &image, "scale", scale, NULL)) {
+		return -1;
+	}
+
+	return imgw_pngsave(image, out, out_len);
+}
+
+static int imgw_pdf_size(void *in, size_t in_len, int page,
+	int *width, int *height) {
+	VipsImage *image;
+
+	if (vips_pdfload_buffer(in, in_len, &image, "page", page, NULL)) {
+		return -1;
+	}
+
+	*width = vips_image_get_width(image);
+	*height = vips_image_get_height(image);
+	g_object_unref(image);
+
+	return 0;
+}
+
+static int imgw_pdf_render(void *in, size_t in_len, int page, double dpi,
+	void **out, size_t *out_len) {
+	VipsImage *image;
+
+	if (vips_pdfload_buffer(in, in_len, &image, "page", page, "dpi", dpi, NULL)) {
+		return -1;
+	}
+
+	return imgw_pngsave(image, out, out_len);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// vipsRasterize renders SVG to PNG with librsvg
+func vipsRasterize(buf []byte, scale float64) ([]byte, error) {
+	var out unsafe.Pointer
+	var outLen C.size_t
+
+	if len(buf) == 0 {
+		return nil, errors.New("Empty image")
+	}
+
+	err := C.imgw_rasterize(unsafe.Pointer(&buf[0]), C.size_t(len(buf)),
+		C.double(scale), &out, &outLen)
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// vipsPDFSize returns size of PDF page at 72 dpi, page is zero-based
+func vipsPDFSize(buf []byte, page int) (int, int, error) {
+	var width, height C.int
+
+	if len(buf) == 0 {
+		return 0, 0, errors.New("Empty image")
+	}
+
+	err := C.imgw_pdf_size(unsafe.Pointer(&buf[0]), C.size_t(len(buf)),
+		C.int(page), &width, &height)
+	if err != 0 {
+		return 0, 0, vipsError()
+	}
+
+	return int(width), int(height), nil
+}
+
+// vipsRasterizePDF renders PDF page to PNG with poppler, page is zero-based
+func vipsRasterizePDF(buf []byte, page int, dpi float64) ([]byte, error) {
+	var out unsafe.Pointer
+	var outLen C.size_t
+
+	if len(buf) == 0 {
+		return nil, errors.New("Empty image")
+	}
+
+	err := C.imgw_pdf_render(unsafe.Pointer(&buf[0]), C.size_t(len(buf)),
+		C.int(page), C.double(dpi), &out, &outLen)
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+func vipsError() error {
+	message := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+
+	return errors.New(message)
+}
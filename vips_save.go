@@ -0,0 +1,309 @@
+package imgwizard
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+enum {
+	IMGW_JPEG,
+	IMGW_WEBP,
+	IMGW_PNG
+};
+
+enum {
+	IMGW_CENTRE,
+	IMGW_NORTH,
+	IMGW_EAST,
+	IMGW_SOUTH,
+	IMGW_WEST
+};
+
+typedef struct {
+	int format;
+	int quality;
+	int interlace;
+	int no_subsample;
+	int lossless;
+	int near_lossless;
+	int compression;
+} ImgwSave;
+
+typedef struct {
+	int area_left;
+	int area_top;
+	int area_width;
+	int area_height;
+	int width;
+	int height;
+	int crop;
+	int enlarge;
+	int gravity;
+	int pad;
+	int flatten;
+	double background[3];
+} ImgwResize;
+
+static int imgw_save_image(VipsImage *image, void **out, size_t *out_len, ImgwSave *s) {
+	switch (s->format) {
+	case IMGW_JPEG:
+		return vips_jpegsave_buffer(image, out, out_len, "Q", s->quality,
+			"interlace", s->interlace, "no_subsample", s->no_subsample, NULL);
+	case IMGW_WEBP:
+		return vips_webpsave_buffer(image, out, out_len, "Q", s->quality,
+			"lossless", s->lossless, "near_lossless", s->near_lossless, NULL);
+	}
+
+	return vips_pngsave_buffer(image, out, out_len,
+		"compression", s->compression, "interlace", s->interlace, NULL);
+}
+
+static int imgw_save(void *in, size_t in_len, void **out, size_t *out_len, ImgwSave *s) {
+	VipsImage *image;
+	int err;
+
+	image = vips_image_new_from_buffer(in, in_len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	err = imgw_save_image(image, out, out_len, s);
+	g_object_unref(image);
+
+	return err;
+}
+
+// imgw_background returns background matching image bands,
+// opaque alpha is added when asked
+static VipsArrayDouble *imgw_background(VipsImage *image, double *rgb, int alpha) {
+	double values[4];
+	int n;
+
+	if (image->Bands >= 3) {
+		values[0] = rgb[0];
+		values[1] = rgb[1];
+		values[2] = rgb[2];
+		n = 3;
+	} else {
+		values[0] = 0.2126 * rgb[0] + 0.7152 * rgb[1] + 0.0722 * rgb[2];
+		n = 1;
+	}
+
+	if (alpha) {
+		values[n++] = 255;
+	}
+
+	return vips_array_double_new(values, n);
+}
+
+static int imgw_resize(void *in, size_t in_len, void **out, size_t *out_len,
+	ImgwResize *r, ImgwSave *s) {
+
+	VipsImage *base, *image;
+	VipsObject *context;
+	VipsImage **t;
+	VipsArrayDouble *background;
+	double xscale, yscale, scale;
+	int width, height, left, top, err;
+
+	base = vips_image_new_from_buffer(in, in_len, "", NULL);
+	if (base == NULL) {
+		return -1;
+	}
+
+	context = VIPS_OBJECT(vips_image_new());
+	t = (VipsImage **) vips_object_local_array(context, 5);
+	image = base;
+	err = -1;
+
+	if (r->area_width > 0 && r->area_height > 0) {
+		if (vips_extract_area(image, &t[4], r->area_left, r->area_top,
+			r->area_width, r->area_height, NULL)) {
+			goto done;
+		}
+		image = t[4];
+	}
+
+	xscale = r->width > 0 ? (double) r->width / image->Xsize : 0;
+	yscale = r->height > 0 ? (double) r->height / image->Ysize : 0;
+	if (xscale == 0 || yscale == 0) {
+		scale = MAX(xscale, yscale);
+	} else {
+		scale = r->crop ? MAX(xscale, yscale) : MIN(xscale, yscale);
+	}
+	if (scale == 0 || (scale > 1 && !r->enlarge)) {
+		scale = 1;
+	}
+
+	if (scale != 1) {
+		if (vips_resize(image, &t[0], scale, NULL)) {
+			goto done;
+		}
+		image = t[0];
+	}
+
+	if (r->crop && r->width > 0 && r->height > 0 &&
+		(image->Xsize > r->width || image->Ysize > r->height)) {
+
+		width = MIN(image->Xsize, r->width);
+		height = MIN(image->Ysize, r->height);
+		left = (image->Xsize - width) / 2;
+		top = (image->Ysize - height) / 2;
+
+		switch (r->gravity) {
+		case IMGW_NORTH:
+			top = 0;
+			break;
+		case IMGW_SOUTH:
+			top = image->Ysize - height;
+			break;
+		case IMGW_WEST:
+			left = 0;
+			break;
+		case IMGW_EAST:
+			left = image->Xsize - width;
+			break;
+		}
+
+		if (vips_extract_area(image, &t[1], left, top, width, height, NULL)) {
+			goto done;
+		}
+		image = t[1];
+	}
+
+	if (r->flatten && vips_image_hasalpha(image)) {
+		background = imgw_background(image, r->background, 0);
+		err = vips_flatten(image, &t[2], "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+		if (err) {
+			goto done;
+		}
+		image = t[2];
+	}
+
+	if (r->pad && r->width > 0 && r->height > 0 &&
+		(image->Xsize < r->width || image->Ysize < r->height)) {
+
+		background = imgw_background(image, r->background, vips_image_hasalpha(image));
+		err = vips_embed(image, &t[3],
+			(r->width - image->Xsize) / 2, (r->height - image->Ysize) / 2,
+			r->width, r->height,
+			"extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+		if (err) {
+			goto done;
+		}
+		image = t[3];
+	}
+
+	err = imgw_save_image(image, out, out_len, s);
+
+done:
+	g_object_unref(context);
+	g_object_unref(base);
+
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/shifr/vips"
+)
+
+var vipsFormats = map[string]C.int{
+	"jpeg": C.IMGW_JPEG,
+	"webp": C.IMGW_WEBP,
+	"png":  C.IMGW_PNG,
+}
+
+var vipsGravities = map[vips.Gravity]C.int{
+	vips.NORTH: C.IMGW_NORTH,
+	vips.EAST:  C.IMGW_EAST,
+	vips.SOUTH: C.IMGW_SOUTH,
+	vips.WEST:  C.IMGW_WEST,
+}
+
+// vipsSave re-encodes image with encoder options
+// which are not supported by vips.Resize
+func vipsSave(buf []byte, format string, quality int, enc EncoderOptions) ([]byte, error) {
+	var out unsafe.Pointer
+	var outLen C.size_t
+
+	if len(buf) == 0 {
+		return nil, errors.New("Empty image")
+	}
+
+	save := saveParams(format, quality, enc)
+	err := C.imgw_save(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, &outLen, &save)
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// vipsResize resizes image like vips.Resize does, flattens and pads it
+// after the shrink and saves with encoder options, so it's encoded once
+func vipsResize(buf []byte, format string, options vips.Options, steps resizeSteps, enc EncoderOptions) ([]byte, error) {
+	var out unsafe.Pointer
+	var outLen C.size_t
+
+	if len(buf) == 0 {
+		return nil, errors.New("Empty image")
+	}
+
+	resize := C.ImgwResize{
+		area_left:   C.int(steps.Area.Min.X),
+		area_top:    C.int(steps.Area.Min.Y),
+		area_width:  C.int(steps.Area.Dx()),
+		area_height: C.int(steps.Area.Dy()),
+		width:       C.int(options.Width),
+		height:      C.int(options.Height),
+		crop:        cBool(options.Crop),
+		enlarge:     cBool(options.Enlarge),
+		gravity:     vipsGravities[options.Gravity],
+		pad:         cBool(steps.Pad),
+		flatten:     cBool(steps.Flatten),
+	}
+	resize.background[0] = C.double(steps.Background.R)
+	resize.background[1] = C.double(steps.Background.G)
+	resize.background[2] = C.double(steps.Background.B)
+	save := saveParams(format, options.Quality, enc)
+
+	err := C.imgw_resize(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, &outLen, &resize, &save)
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+func saveParams(format string, quality int, enc EncoderOptions) C.ImgwSave {
+	compression := enc.Compression
+	if compression == 0 {
+		compression = PNG_DEFAULT_COMPRESSION
+	}
+
+	return C.ImgwSave{
+		format:        vipsFormats[format],
+		quality:       C.int(quality),
+		interlace:     cBool(enc.Progressive),
+		no_subsample:  cBool(enc.Subsampling == "444"),
+		lossless:      cBool(enc.Lossless != ""),
+		near_lossless: cBool(enc.Lossless == "near"),
+		compression:   C.int(compression),
+	}
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}